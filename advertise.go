@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// AdvertiseResolver returns the host:port the local member advertises, such as the public mapping
+// of a node behind NAT fetched from the instance metadata or discovered with STUN.
+type AdvertiseResolver func() (string, error)
+
+// SetAdvertiseResolver sets the function Start calls to obtain the advertise address of the local
+// member, for environments where it is known neither from the configuration nor from the local
+// interfaces. The resolved address overrides the advertise address of the member, including the
+// one of SetInterface, and is resolved again on every restart, such as by Rejoin. An error of the
+// function fails Start with ErrAdvertiseResolver. It defaults to nil, which keeps the advertise
+// address of the member. It must be called before Start.
+func (s *Serf) SetAdvertiseResolver(fn AdvertiseResolver) {
+	s.advertiseResolver = fn
+}
+
+// resolveAdvertise replaces the advertise address of the local member with the one returned by
+// the advertise resolver, if it is set.
+func (s *Serf) resolveAdvertise() error {
+	if s.advertiseResolver == nil {
+		return nil
+	}
+
+	addr, err := s.advertiseResolver()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAdvertiseResolver, err)
+	}
+	if _, _, err := s.splitHostPort(addr); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrAdvertiseAddr, addr, err)
+	}
+	if addr != s.member.Advertise {
+		log.Printf("[INFO] Serf advertise addr resolved, id:%s, addr:%s\n", s.member.Id, addr)
+	}
+	s.member.Advertise = addr
+	return nil
+}
+
+// UpdateAdvertise advertises the local member on a new address, such as after the IP of the host
+// changed on a DHCP lease change or a failover, so that peers can reach it again without a
+// restart of the process. If the bind address was the old advertise address, the member binds
+// on the new one too. Memberlist can't change the address of a running node, so the member
+// gracefully leaves the cluster and rejoins it from the new address, see SetRejoinInterval.
+// If the rejoin fails, such as when the new address can't be bound, the previous addresses are
+// restored and the member rejoins from them, so it isn't left out of the cluster, and
+// ErrReadvertise is returned. It returns ErrNotStarted if serf is not started.
+func (s *Serf) UpdateAdvertise(addr string) error {
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	if _, _, err := s.splitHostPort(addr); err != nil {
+		return err
+	}
+	if addr == s.member.Advertise {
+		return nil
+	}
+
+	old, oldBind := s.member.Advertise, s.member.Bind
+	if err := s.Leave(); err != nil {
+		return err
+	}
+	if s.member.Bind == old {
+		s.member.Bind = addr
+	}
+	s.member.Advertise = addr
+	log.Printf("[INFO] Serf re-advertising the local member, id:%s, old:%s, new:%s\n", s.member.Id, old, addr)
+
+	err := s.rejoin()
+	if err == nil {
+		return nil
+	}
+	log.Printf("[WARN] Serf rejoin from advertise addr:%s failed, rolling back to:%s, err:%s\n", addr, old, err.Error())
+	s.member.Bind, s.member.Advertise = oldBind, old
+	if rerr := s.rejoin(); rerr != nil {
+		return fmt.Errorf("%w: %s: %w, rollback to %s: %w", ErrReadvertise, addr, err, old, rerr)
+	}
+	return fmt.Errorf("%w: %s, rolled back to %s: %w", ErrReadvertise, addr, old, err)
+}
+
+// ReconcileAdvertise resolves the address of the network interface set with SetInterface again,
+// and re-advertises the local member like UpdateAdvertise if it changed. It returns whether the
+// member was re-advertised. Callers detect address changes by calling it periodically or on
+// network events. It returns ErrInterface if no interface is set.
+//
+// The previous address is gone from the interface, so a failed rejoin can't be rolled back like
+// UpdateAdvertise does. The rejoin is retried as set by SetRejoinInterval, and if it still fails
+// ErrReadvertise is returned and the member stays out of the cluster until the next call, which
+// retries the rejoin even if the address didn't change again.
+func (s *Serf) ReconcileAdvertise() (bool, error) {
+	if s.serf == nil && !s.rejoinPending {
+		return false, ErrNotStarted
+	}
+	if s.iface == "" {
+		return false, fmt.Errorf("%w: no interface is set", ErrInterface)
+	}
+	if s.rejoinPending {
+		log.Printf("[INFO] Serf retrying the rejoin after re-advertising on interface:%s\n", s.iface)
+		return true, s.reconcileRejoin()
+	}
+
+	ip, err := interfaceAddr(s.iface)
+	if err != nil {
+		return false, err
+	}
+	host, _, err := net.SplitHostPort(s.member.Advertise)
+	if err != nil {
+		return false, ErrParseAddrToHostPort
+	}
+	if host == ip {
+		return false, nil
+	}
+
+	// Start binds and advertises on the new address of the interface.
+	log.Printf("[INFO] Serf interface:%s address changed, old:%s, new:%s\n", s.iface, host, ip)
+	if err := s.Leave(); err != nil {
+		return false, err
+	}
+	return true, s.reconcileRejoin()
+}
+
+// reconcileRejoin rejoins the cluster from the address of the interface, and records whether the
+// next ReconcileAdvertise must retry it.
+func (s *Serf) reconcileRejoin() error {
+	err := s.rejoin()
+	s.rejoinPending = err != nil
+	if err != nil {
+		log.Printf("[WARN] Serf rejoin from interface:%s failed, retried on the next reconcile, err:%s\n", s.iface, err.Error())
+		return fmt.Errorf("%w: interface:%s: %w", ErrReadvertise, s.iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// auditQueueSize is the number of audit records that can be buffered before new records are dropped.
+const auditQueueSize = 1024
+
+// AuditRecord is a single membership transition written to the audit log as one JSON line.
+type AuditRecord struct {
+	Time  time.Time         `json:"time"`  // the time the transition was observed
+	Event string            `json:"event"` // the serf event type, such as "member-join"
+	Id    string            `json:"id"`    // the member ID
+	Addr  string            `json:"addr"`  // the advertised address of the member
+	Tags  map[string]string `json:"tags"`  // a snapshot of the member tags
+
+	// Seq is the sequence number of the transition, see MemberEvent.Seq. Reaps have none.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Recovered is set on the join of a member that failed recently, which tells a transient
+	// failure apart from a member that left for good. A suspect member rejoining within the
+	// failed grace is recorded as a recovered "member-update", not as a join.
+	Recovered bool `json:"recovered,omitempty"`
+}
+
+// auditor writes audit records on its own goroutine, so a slow writer never blocks the event loop.
+type auditor struct {
+	w       io.Writer
+	records chan *AuditRecord
+	done    chan struct{}
+	dropped int // records dropped since the queue last had room, only used by record
+}
+
+// newAuditor creates an auditor and starts its writing goroutine.
+func newAuditor(w io.Writer) *auditor {
+	a := &auditor{
+		w:       w,
+		records: make(chan *AuditRecord, auditQueueSize),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// record queues a record without blocking, and returns false if the record was dropped because
+// the queue is full. A warning is logged when the drops start, and once the queue has room again.
+func (a *auditor) record(r *AuditRecord) bool {
+	select {
+	case a.records <- r:
+		if a.dropped > 0 {
+			log.Printf("[WARN] audit queue has room again, dropped %d records\n", a.dropped)
+			a.dropped = 0
+		}
+		return true
+	default:
+		if a.dropped == 0 {
+			log.Printf("[WARN] audit queue is full, dropping records, first dropped %s record of member:%s\n", r.Event, r.Id)
+		}
+		a.dropped++
+		return false
+	}
+}
+
+// run writes the queued records until the auditor is closed.
+func (a *auditor) run() {
+	defer close(a.done)
+	encoder := json.NewEncoder(a.w)
+	for r := range a.records {
+		if err := encoder.Encode(r); err != nil {
+			log.Printf("[ERROR] write audit record err:%s\n", err.Error())
+		}
+	}
+}
+
+// close flushes the queued records and stops the writing goroutine.
+func (a *auditor) close() {
+	close(a.records)
+	<-a.done
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// DefaultBindBackoff is the default delay before the first retry of a bind address in use, see SetBindRetry.
+const DefaultBindBackoff = 100 * time.Millisecond
+
+// SetBindRetry sets how many times Start attempts to create serf while the bind address is in
+// use, such as on a fast restart where the previous process hasn't released the port yet. The
+// delay between the attempts starts at backoff, DefaultBindBackoff if it is zero, and doubles on
+// every retry. Other errors, such as a malformed configuration, fail Start at once. An attempts
+// of zero or one, the default, doesn't retry. It must be called before Start.
+func (s *Serf) SetBindRetry(attempts int, backoff time.Duration) {
+	s.bindAttempts = attempts
+	s.bindBackoff = backoff
+}
+
+// createSerf creates the serf agent of the configuration, retrying while the bind address is in use.
+func (s *Serf) createSerf(cfg *serf.Config) (*serf.Serf, error) {
+	backoff := s.bindBackoff
+	if backoff <= 0 {
+		backoff = DefaultBindBackoff
+	}
+
+	// serf wraps the event channel of the configuration when it has a snapshot, restore it for the retries.
+	events := cfg.EventCh
+	for attempt := 1; ; attempt++ {
+		agent, err := serf.Create(cfg)
+		if err == nil || attempt >= s.bindAttempts || !isAddrInUse(err) {
+			return agent, err
+		}
+
+		log.Printf("[WARN] Serf bind addr:%s is in use, retrying in %s, attempt:%d/%d\n", s.member.Bind, backoff, attempt, s.bindAttempts)
+		<-s.clock.After(backoff)
+		backoff *= 2
+		cfg.EventCh = events
+	}
+}
+
+// isAddrInUse returns true if the error is caused by an address already in use. Memberlist
+// formats the listener errors into its own, so the message is matched too.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), syscall.EADDRINUSE.Error())
+}
@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"hash/crc32"
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/werbenhu/chash"
+)
+
+// DefaultLoadFactor is the default bound of the load of a service relative to the mean load of
+// its group, see MatchBounded.
+const DefaultLoadFactor = 1.25
+
+// boundedLoads tracks the load of the services for the consistent hashing with bounded loads.
+type boundedLoads struct {
+	sync.Mutex
+	rings map[string]*boundedRing   // the cached ring of every group, rebuilt after it changes
+	loads map[string]map[string]int // the load of every service by ID, by group
+}
+
+// boundedRing is the ring of a group with the services of its points.
+type boundedRing struct {
+	points   []ringPoint
+	services map[string]*Service
+}
+
+// MatchBounded is like Match, with consistent hashing with bounded loads: the key is assigned to
+// the service owning it on the ring unless that service already carries more than the load factor
+// times the mean load of the group, in which case it spills over to the next service on the ring
+// below the bound. Hot keys can't overwhelm one service, while most keys keep their service.
+// The load factor is set by OptLoadFactor.
+//
+// The load of a service is the number of keys matched to it and not yet released, the caller
+// must call the returned function once it is done with the service, such as when the request
+// completes. See RingLoad for the current loads.
+func (s *Registry) MatchBounded(groupName string, key string) (*Service, func(), error) {
+	group, err := chash.GetGroup(groupName)
+	if err != nil {
+		return nil, nil, err
+	}
+	owner, _, err := group.Match(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.bounded.Lock()
+	defer s.bounded.Unlock()
+	ring := s.boundedRing(groupName, group)
+	loads := s.groupLoads(groupName)
+	if len(ring.services) == 0 {
+		return nil, nil, chash.ErrNoResultMatched
+	}
+
+	total := 0
+	for _, load := range loads {
+		total += load
+	}
+	factor := s.opt.LoadFactor
+	if factor <= 1 {
+		factor = DefaultLoadFactor
+	}
+	limit := int(math.Ceil(factor * float64(total+1) / float64(len(ring.services))))
+
+	// The owner of the key takes it if it is below the bound, otherwise the key walks the ring
+	// from the point after the one owning it. Some service is always below the bound, since the
+	// bounds of all the services add up to more than the total load.
+	id := owner
+	if _, ok := ring.services[id]; !ok || loads[id] >= limit {
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(ring.points), func(i int) bool {
+			return ring.points[i].hash > hash
+		})
+		for i := 0; i < len(ring.points); i++ {
+			if p := ring.points[(start+i)%len(ring.points)]; loads[p.id] < limit {
+				id = p.id
+				break
+			}
+		}
+	}
+
+	loads[id]++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.bounded.Lock()
+			defer s.bounded.Unlock()
+			if loads := s.bounded.loads[groupName]; loads[id] > 0 {
+				loads[id]--
+			}
+		})
+	}
+	return ring.services[id], release, nil
+}
+
+// RingLoad returns the load of every service of the group on the consistent hash ring by
+// service ID, the number of keys matched to it by MatchBounded and not yet released. It returns
+// an empty map if the group has no services.
+func (s *Registry) RingLoad(groupName string) map[string]int {
+	load := make(map[string]int)
+	group, err := chash.GetGroup(groupName)
+	if err != nil {
+		return load
+	}
+
+	s.bounded.Lock()
+	defer s.bounded.Unlock()
+	loads := s.groupLoads(groupName)
+	for id := range s.boundedRing(groupName, group).services {
+		load[id] = loads[id]
+	}
+	return load
+}
+
+// boundedRing returns the cached ring of the group, rebuilding it if it has changed.
+// It must be called with the lock of the bounded loads held.
+func (s *Registry) boundedRing(groupName string, group *chash.Group) *boundedRing {
+	if s.bounded.rings == nil {
+		s.bounded.rings = make(map[string]*boundedRing)
+	}
+	if ring, ok := s.bounded.rings[groupName]; ok {
+		return ring
+	}
+
+	ring := &boundedRing{
+		points:   ringPoints(group),
+		services: make(map[string]*Service),
+	}
+	for _, element := range group.GetElements() {
+		m := &Member{}
+		if err := m.Unmarshal(element.Payload); err != nil {
+			log.Printf("[ERROR] element to member err:%s\n", err.Error())
+			continue
+		}
+		ring.services[element.Key] = &m.Service
+	}
+	s.bounded.rings[groupName] = ring
+	return ring
+}
+
+// groupLoads returns the loads of the services of the group.
+// It must be called with the lock of the bounded loads held.
+func (s *Registry) groupLoads(groupName string) map[string]int {
+	if s.bounded.loads == nil {
+		s.bounded.loads = make(map[string]map[string]int)
+	}
+	loads, ok := s.bounded.loads[groupName]
+	if !ok {
+		loads = make(map[string]int)
+		s.bounded.loads[groupName] = loads
+	}
+	return loads
+}
+
+// ringChanged drops the cached ring of the group after a service was added, updated or removed,
+// and the load of the service if it was removed.
+func (s *Registry) ringChanged(groupName string, id string, removed bool) {
+	s.bounded.Lock()
+	defer s.bounded.Unlock()
+	delete(s.bounded.rings, groupName)
+	if removed {
+		delete(s.bounded.loads[groupName], id)
+	}
+}
@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the time-based features, such as the leave grace window,
+// the health debounce, the periodic sweeps and the rejoin attempts. It defaults to the real
+// clock, tests can use a FakeClock to advance time deterministically.
+type Clock interface {
+
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel receiving the current time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc calls f once d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker returns a ticker sending the current time on every period d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a pending call of Clock.AfterFunc.
+type Timer interface {
+
+	// Stop prevents the call, it returns false if the call has already happened or been stopped.
+	Stop() bool
+}
+
+// Ticker is a ticker of Clock.NewTicker.
+type Ticker interface {
+
+	// C returns the channel the ticks are sent on.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// SetClock sets the clock of the time-based features. It must be called before Start.
+func (s *Serf) SetClock(c Clock) {
+	s.clock = c
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+// Now implements Clock.
+func (realClock) Now() time.Time { return time.Now() }
+
+// After implements Clock.
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// AfterFunc implements Clock.
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// NewTicker implements Clock.
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker is the Ticker of the time package.
+type realTicker struct {
+	*time.Ticker
+}
+
+// C implements Ticker.
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// FakeClock is a Clock that only moves when it is advanced, for deterministic tests.
+type FakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending timer, ticker or After channel of a FakeClock.
+type fakeWaiter struct {
+	clock  *FakeClock
+	at     time.Time          // the time the waiter is due
+	period time.Duration      // the period of a ticker, 0 for a one-shot waiter
+	fire   func(at time.Time) // called when the waiter is due
+}
+
+// fakeTicker is the Ticker of a FakeClock.
+type fakeTicker struct {
+	waiter *fakeWaiter
+	ch     chan time.Time
+}
+
+// NewFakeClock creates a FakeClock whose current time is now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// After implements Clock.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(d, 0, func(at time.Time) { ch <- at })
+	return ch
+}
+
+// AfterFunc implements Clock. Unlike time.AfterFunc, f is called by Advance itself.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, 0, func(time.Time) { f() })
+}
+
+// NewTicker implements Clock. A tick is dropped if the previous one has not been received.
+// Like time.NewTicker, it panics if d is not positive.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	ch := make(chan time.Time, 1)
+	w := c.add(d, d, func(at time.Time) {
+		select {
+		case ch <- at:
+		default:
+		}
+	})
+	return &fakeTicker{waiter: w, ch: ch}
+}
+
+// Advance moves the clock forward by d, and fires the timers, tickers and After channels
+// that are due, in the order of their due times.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	end := c.now.Add(d)
+	c.Unlock()
+
+	for {
+		c.Lock()
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].at.Before(c.waiters[j].at)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			c.now = end
+			c.Unlock()
+			return
+		}
+
+		w := c.waiters[0]
+		c.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+		at := c.now
+		c.Unlock()
+		w.fire(at)
+	}
+}
+
+// add registers a waiter due after d.
+func (c *FakeClock) add(d time.Duration, period time.Duration, fire func(at time.Time)) *fakeWaiter {
+	c.Lock()
+	defer c.Unlock()
+	w := &fakeWaiter{clock: c, at: c.now.Add(d), period: period, fire: fire}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// remove unregisters a waiter, and returns false if it was not pending.
+func (c *FakeClock) remove(w *fakeWaiter) bool {
+	c.Lock()
+	defer c.Unlock()
+	for i, pending := range c.waiters {
+		if pending == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Stop implements Timer.
+func (w *fakeWaiter) Stop() bool {
+	return w.clock.remove(w)
+}
+
+// C implements Ticker.
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop implements Ticker.
+func (t *fakeTicker) Stop() {
+	t.waiter.clock.remove(t.waiter)
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/rs/xid"
+)
+
+// tagMagicByte is the byte serf prefixes to the msgpack encoded tags in the memberlist node meta.
+const tagMagicByte = 255
+
+// NameConflictPolicy decides what Start does when another node of the cluster already uses the local node name.
+type NameConflictPolicy int
+
+const (
+	// NameConflictError makes Start shut down and return ErrNameConflict, this is the default.
+	NameConflictError NameConflictPolicy = iota
+
+	// NameConflictSuffix makes Start retry once with the node name suffixed by a random token.
+	// The member ID is suffixed as well when it is equal to the node name.
+	NameConflictSuffix
+)
+
+// NameConflictFunc is called when Start detects a node name conflict while joining.
+// existing is the local node and conflicting is the remote node claiming the same name.
+// It returns the policy to apply to the conflict.
+type NameConflictFunc func(existing *serf.Member, conflicting *serf.Member) NameConflictPolicy
+
+// nameConflict is a node name conflict seen in the alive messages of memberlist.
+type nameConflict struct {
+	existing    *serf.Member
+	conflicting *serf.Member
+}
+
+// aliveDelegate checks the alive messages claiming the local node name, see checkAlive. Serf
+// installs its own conflict delegate on memberlist, but memberlist passes every alive message to
+// the alive delegate before it checks the message for a conflict, so the conflicts are recorded
+// there. When a merge delegate is set serf installs its own alive delegate too, and the merge
+// delegate checks the messages instead.
+type aliveDelegate struct {
+	serf *Serf
+	next memberlist.AliveDelegate
+}
+
+// NotifyAlive implements memberlist.AliveDelegate.
+func (d *aliveDelegate) NotifyAlive(node *memberlist.Node) error {
+	if d.next != nil {
+		if err := d.next.NotifyAlive(node); err != nil {
+			return err
+		}
+	}
+	d.serf.checkAlive(nodeToMember(node))
+	return nil
+}
+
+// checkAlive checks an alive message claiming the local node name. From the address memberlist
+// advertises it is the local node gossiped alive by a peer, see OnSelfRejoined, from another one
+// it is a node name conflict. The first conflict is kept until Start takes it.
+func (s *Serf) checkAlive(member *serf.Member) {
+	if member.Name != s.nodeName() {
+		return
+	}
+
+	s.conflictLock.Lock()
+	defer s.conflictLock.Unlock()
+	// The local node gossips its own alive message while serf is created, from the address
+	// memberlist resolved, which may differ from the configured one, such as ":7370".
+	local := s.localNode
+	if local == nil {
+		return
+	}
+	if local.Addr.Equal(member.Addr) && local.Port == member.Port {
+		s.selfAlive()
+		return
+	}
+	if s.conflict == nil {
+		s.conflict = &nameConflict{
+			existing:    &serf.Member{Name: member.Name, Addr: local.Addr, Port: local.Port, Tags: s.localTags()},
+			conflicting: member,
+		}
+	}
+}
+
+// setLocalNode sets the local node the alive messages are compared with, nil while serf is created.
+func (s *Serf) setLocalNode(m *serf.Member) {
+	s.conflictLock.Lock()
+	defer s.conflictLock.Unlock()
+	s.localNode = m
+}
+
+// nodeToMember converts a memberlist node to a serf member, decoding the tags from the node meta.
+func nodeToMember(node *memberlist.Node) *serf.Member {
+	tags := make(map[string]string)
+	if len(node.Meta) > 0 && node.Meta[0] == tagMagicByte {
+		dec := codec.NewDecoder(bytes.NewReader(node.Meta[1:]), &codec.MsgpackHandle{})
+		if err := dec.Decode(&tags); err != nil {
+			log.Printf("[ERROR] serf decode tags of node:%s err:%s\n", node.Name, err.Error())
+		}
+	}
+	return &serf.Member{
+		Name: node.Name,
+		Addr: node.Addr,
+		Port: node.Port,
+		Tags: tags,
+	}
+}
+
+// SetNameConflictPolicy sets the policy applied when Start detects that another node already uses
+// the local node name. It must be called before Start.
+func (s *Serf) SetNameConflictPolicy(p NameConflictPolicy) {
+	s.conflictPolicy = p
+}
+
+// OnNameConflict sets the function that decides the policy applied to a node name conflict detected
+// by Start, overriding the policy set by SetNameConflictPolicy. It must be called before Start.
+func (s *Serf) OnNameConflict(fn NameConflictFunc) {
+	s.onNameConflict = fn
+}
+
+// SetDeadNodeReclaimTime sets how long a failed node must have been dead before another node
+// with the same name but a different address may take its place. It defaults to 0, which
+// never allows it, so a pod restarting with the same Id on a new IP is refused until the dead
+// entry is reaped, which serf does after its ReconnectTimeout of 24 hours. Under stateful-set
+// style identities, a reclaim time of a few seconds lets the restarted node rejoin promptly.
+// It is applied by the nodes that already know the dead node, so it should be set on every node.
+// It must be called before Start.
+func (s *Serf) SetDeadNodeReclaimTime(d time.Duration) {
+	s.reclaimTime = d
+}
+
+// takeConflict returns and clears the recorded node name conflict, if any.
+func (s *Serf) takeConflict() *nameConflict {
+	s.conflictLock.Lock()
+	defer s.conflictLock.Unlock()
+	c := s.conflict
+	s.conflict = nil
+	return c
+}
+
+// resolveConflict applies the conflict policy after joining. It returns ErrNameConflict
+// if the conflict can't be resolved, or the result of restarting under a suffixed name.
+func (s *Serf) resolveConflict(c *nameConflict, retry bool) error {
+	policy := s.conflictPolicy
+	if s.onNameConflict != nil {
+		policy = s.onNameConflict(c.existing, c.conflicting)
+	}
+
+	log.Printf("[ERROR] serf node name:%s conflicts with the node at %s:%d\n",
+		c.conflicting.Name, c.conflicting.Addr, c.conflicting.Port)
+	s.stopping.Store(true)
+	s.serf.Shutdown()
+	<-s.serf.ShutdownCh()
+	s.stopLoop()
+	s.deleteMember(s.member.Id)
+
+	if policy != NameConflictSuffix || !retry {
+		return fmt.Errorf("%w: %s", ErrNameConflict, c.conflicting.Name)
+	}
+
+	name := s.nodeName()
+	suffixed := name + "-" + xid.New().String()
+	if s.member.Id == name {
+		s.member.Id = suffixed
+		s.member.Service.Id = suffixed
+	}
+	s.member.Name = suffixed
+	log.Printf("[INFO] serf retries with node name:%s\n", suffixed)
+	return s.start(false)
+}
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"strconv"
+	"time"
+)
+
+// SetConvergenceTracking sets whether the local member advertises the time it started in the
+// joined_ts tag, and whether the join of a member advertising that tag is recorded as a gossip
+// convergence latency, the time from the member starting to this node learning about it.
+//
+// The latency is computed against the local clock, so it assumes the clocks of the cluster are
+// synchronized. Samples made negative or zero by clock skew are counted separately in
+// MetricConvergenceSkew instead of being recorded. It must be called before Start.
+func (s *Serf) SetConvergenceTracking(enable bool) {
+	s.trackConvergence = enable
+}
+
+// observeConvergence records the convergence latency of a joined member advertising the joined_ts tag.
+func (s *Serf) observeConvergence(m *Member) {
+	if !s.trackConvergence || s.metrics == nil || m.Id == s.member.Id {
+		return
+	}
+
+	val, ok := m.GetTag(TagJoinedTs)
+	if !ok {
+		return
+	}
+	ts, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return
+	}
+
+	latency := s.clock.Now().Sub(time.Unix(0, ts))
+	if latency <= 0 {
+		s.metrics.IncrCounter(MetricConvergenceSkew, 1)
+		return
+	}
+	s.metrics.ObserveDuration(MetricConvergence, latency)
+}
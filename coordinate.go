@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// SetDisableCoordinates sets whether serf stops gossiping the Vivaldi network coordinates, which
+// saves bandwidth on very large or constrained clusters. When disabled, the distance based features
+// are unavailable: Coordinate and DistanceTo return ErrCoordinatesDisabled.
+// It must be called before Start.
+func (s *Serf) SetDisableCoordinates(disable bool) {
+	s.disableCoordinates = disable
+}
+
+// Coordinate returns the network coordinate serf estimated for the member of the ID.
+// It returns ErrCoordinatesDisabled when coordinates are disabled, and ErrCoordinateNotFound
+// when serf has not yet estimated a coordinate for the member.
+func (s *Serf) Coordinate(id string) (*coordinate.Coordinate, error) {
+	if s.serf == nil {
+		return nil, ErrNotStarted
+	}
+
+	// The local coordinate is also used to tell whether coordinates are enabled.
+	local, err := s.serf.GetCoordinate()
+	if err != nil {
+		return nil, ErrCoordinatesDisabled
+	}
+	if id == s.member.Id {
+		return local, nil
+	}
+
+	m := s.loadMember(id)
+	if m == nil {
+		return nil, ErrMemberNotFound
+	}
+	name := m.Name
+	if name == "" {
+		name = m.Id
+	}
+
+	coord, ok := s.serf.GetCachedCoordinate(name)
+	if !ok {
+		return nil, ErrCoordinateNotFound
+	}
+	return coord, nil
+}
+
+// DistanceTo returns the round trip time to the member of the ID estimated from the network
+// coordinates. The estimate is a best effort and is only as accurate as the coordinates are.
+func (s *Serf) DistanceTo(id string) (time.Duration, error) {
+	local, err := s.Coordinate(s.member.Id)
+	if err != nil {
+		return 0, err
+	}
+	other, err := s.Coordinate(id)
+	if err != nil {
+		return 0, err
+	}
+	return local.DistanceTo(other), nil
+}
+
+// MembersByDistance returns the members of the group sorted from the nearest to the farthest by
+// the round trip time estimated from the network coordinates, the order a latency-aware failover
+// tries them in. The local member, if it is in the group, is usually the nearest. Members without
+// a coordinate come last in ID order, and so do all of them when coordinates are disabled.
+// Leaving members are excluded. The order is a best effort estimate, see DistanceTo, it doesn't
+// guarantee that a member ordered first answers faster.
+func (s *Serf) MembersByDistance(group string) []*Member {
+	members := s.candidates(group, nil)
+	rtts := make(map[string]time.Duration, len(members))
+	for _, m := range members {
+		if rtt, err := s.DistanceTo(m.Id); err == nil {
+			rtts[m.Id] = rtt
+		}
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		ri, iok := rtts[members[i].Id]
+		rj, jok := rtts[members[j].Id]
+		if iok != jok {
+			return iok
+		}
+		return iok && ri < rj
+	})
+	return members
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"sort"
+	"sync"
+)
+
+// TagService is the optional tag key of the service a member provides, for groups whose
+// members provide several services. It is used to break member counts down by service, see Services.
+const TagService = "service"
+
+// CountMetrics is implemented by the metrics sinks that track the number of members per group
+// and per service. The counts are reported on every membership change that alters them.
+type CountMetrics interface {
+
+	// SetGroupCount sets the number of members of the group.
+	SetGroupCount(group string, n int)
+
+	// SetServiceCount sets the number of members providing the service, see TagService.
+	SetServiceCount(service string, n int)
+}
+
+// memberKey is what a member is counted under.
+type memberKey struct {
+	group   string
+	service string
+}
+
+// memberCounts counts the members per group and per service incrementally.
+// It is only updated by the event loop.
+type memberCounts struct {
+	sync.Mutex
+	counted  map[string]memberKey // the key every counted member is counted under, by ID
+	groups   map[string]int       // the number of members per group
+	services map[string]int       // the number of members per service
+}
+
+// recount moves the member of the ID from the key it was counted under to the key of latest,
+// and reports the changed counts. A nil or leaving latest member is no longer counted.
+func (s *Serf) recount(id string, latest *Member) {
+	c := &s.counts
+	c.Lock()
+	defer c.Unlock()
+	if c.counted == nil {
+		c.counted = make(map[string]memberKey)
+		c.groups = make(map[string]int)
+		c.services = make(map[string]int)
+	}
+
+	alive := latest != nil && !latest.IsLeaving()
+	var key memberKey
+	if alive {
+		service, _ := latest.GetTag(TagService)
+		key = memberKey{group: latest.Service.Group, service: service}
+	}
+
+	old, counted := c.counted[id]
+	if counted == alive && old == key {
+		return
+	}
+	if counted {
+		delete(c.counted, id)
+		s.addCount(old, -1)
+	}
+	if alive {
+		c.counted[id] = key
+		s.addCount(key, 1)
+	}
+}
+
+// addCount adds delta to the counts of the key and reports them, the caller must hold the lock.
+func (s *Serf) addCount(key memberKey, delta int) {
+	c := &s.counts
+	sink, _ := s.metrics.(CountMetrics)
+
+	c.groups[key.group] += delta
+	if sink != nil {
+		sink.SetGroupCount(key.group, c.groups[key.group])
+	}
+	if c.groups[key.group] == 0 {
+		delete(c.groups, key.group)
+	}
+
+	if key.service == "" {
+		return
+	}
+	c.services[key.service] += delta
+	if sink != nil {
+		sink.SetServiceCount(key.service, c.services[key.service])
+	}
+	if c.services[key.service] == 0 {
+		delete(c.services, key.service)
+	}
+}
+
+// Groups returns the sorted names of the groups that have members, such as for a dashboard
+// enumerating what exists right now. Leaving members are not counted. The groups are maintained
+// incrementally as members join, leave and update, so the call doesn't scan the members.
+func (s *Serf) Groups() []string {
+	s.counts.Lock()
+	defer s.counts.Unlock()
+	return sortedKeys(s.counts.groups)
+}
+
+// Services returns the sorted distinct values of the service tag of the members, see TagService
+// and Groups.
+func (s *Serf) Services() []string {
+	s.counts.Lock()
+	defer s.counts.Unlock()
+	return sortedKeys(s.counts.services)
+}
+
+// sortedKeys returns the sorted keys of the counts.
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Describe returns a human readable snapshot of the node for support bundles and issue reports:
+// the local member with its tags, the member counts per group and service, the encryption, the
+// gossip settings and the serf stats. It is safe to call at any time, before Start it reports
+// that serf is not started.
+func (s *Serf) Describe() string {
+	b := &strings.Builder{}
+	state := "not started"
+	if s.serf != nil {
+		state = s.serf.State().String()
+	}
+	fmt.Fprintf(b, "serf: %s\n", state)
+
+	m := s.member
+	fmt.Fprintf(b, "local member: id=%s name=%s bind=%s advertise=%s group=%s addr=%s replicas=%s status=%s\n",
+		m.Id, s.nodeName(), m.Bind, m.Advertise, m.Service.Group, m.Service.Addr, m.Replicas, m.Status)
+	fmt.Fprintf(b, "local tags: %s\n", describePairs(m.GetTags()))
+
+	groups := make(map[string]int)
+	services := make(map[string]int)
+	total := 0
+	s.RangeMembers(func(m *Member) bool {
+		total++
+		groups[m.Service.Group]++
+		if service, ok := m.GetTag(TagService); ok {
+			services[service]++
+		}
+		return true
+	})
+	fmt.Fprintf(b, "members: %d, version: %d\n", total, s.MembershipVersion())
+	fmt.Fprintf(b, "groups: %s\n", describeCounts(groups))
+	fmt.Fprintf(b, "services: %s\n", describeCounts(services))
+
+	encryption := "off"
+	if s.EncryptionEnabled() {
+		encryption = "on"
+	}
+	fmt.Fprintf(b, "encryption: %s\n", encryption)
+	fmt.Fprintf(b, "gossip: protocol=%s interval=%s nodes=%s push/pull=%s\n",
+		describeSetting(s.protocol != 0, s.protocol),
+		describeSetting(s.gossipInterval != 0, s.gossipInterval),
+		describeSetting(s.gossipInterval != 0, s.gossipNodes),
+		describeSetting(s.pushPullInterval != 0, s.pushPullInterval))
+	fmt.Fprintf(b, "serf stats: %s\n", describePairs(s.Stats()))
+	return b.String()
+}
+
+// describeSetting formats a setting, which is the serf default if it is not set.
+func describeSetting(set bool, val any) string {
+	if !set {
+		return "default"
+	}
+	return fmt.Sprint(val)
+}
+
+// describePairs formats a map as key=value pairs sorted by key, or "none" if it is empty.
+func describePairs(m map[string]string) string {
+	if len(m) == 0 {
+		return "none"
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+m[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// describeCounts formats counts as key=count pairs sorted by key, or "none" if there are none.
+func describeCounts(counts map[string]int) string {
+	pairs := make(map[string]string, len(counts))
+	for k, n := range counts {
+		pairs[k] = strconv.Itoa(n)
+	}
+	return describePairs(pairs)
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import "sort"
+
+// Diff returns the changes of the members since prev, a snapshot of the members captured
+// earlier, such as by Members, so that consumers polling the members can reconcile the deltas
+// instead of subscribing. joined are the members not in prev, left are the members of prev
+// that are gone, and changed are the current members that are not equal to their previous
+// version, see Member.Equal. Each is sorted by ID.
+//
+// Members are replaced when they change, except the local member whose tags are updated in
+// place, so a snapshot meant to see the changes of the local member must hold clones of the
+// members, see Member.Clone.
+func (s *Serf) Diff(prev []*Member) (joined, left, changed []*Member) {
+	previous := make(map[string]*Member, len(prev))
+	for _, m := range prev {
+		previous[m.Id] = m
+	}
+
+	joined = make([]*Member, 0)
+	changed = make([]*Member, 0)
+	for _, m := range s.Members() {
+		p, ok := previous[m.Id]
+		if !ok {
+			joined = append(joined, m)
+		} else if !p.Equal(m) {
+			changed = append(changed, m)
+		}
+		delete(previous, m.Id)
+	}
+
+	left = make([]*Member, 0, len(previous))
+	for _, m := range previous {
+		left = append(left, m)
+	}
+
+	for _, members := range [][]*Member{joined, left, changed} {
+		sortById(members)
+	}
+	return joined, left, changed
+}
+
+// sortById sorts the members by ID.
+func sortById(members []*Member) {
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id < members[j].Id
+	})
+}
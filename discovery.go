@@ -4,19 +4,51 @@
 
 package registry
 
-// Auto-discover event notification interface
+import "context"
+
+// Auto-discover event notification interface.
+//
+// The methods are called one at a time from a single event loop, in the order serf delivered
+// the events. The events of a given member are never reordered, so a handler observes a join,
+// its updates and the leave of a member in that exact order, and a slow method delays the
+// following events instead of letting them overtake it. Subscribers receive each event after
+// the handler has returned, in the same order.
+//
+// The context of a call is cancelled once the handler timeout has passed, see SetHandlerTimeout.
 type Handler interface {
 
 	// OnMemberJoin is triggered when a new service is registered.
-	OnMemberJoin(*Member) error
+	OnMemberJoin(context.Context, *Member) error
 
 	// OnMemberLeave is triggered when a service leaves.
-	OnMemberLeave(*Member) error
+	OnMemberLeave(context.Context, *Member) error
 
 	// OnMemberUpdate is triggered when a service is updated.
-	OnMemberUpdate(*Member) error
+	OnMemberUpdate(context.Context, *Member) error
 }
 
+// BaseHandler is a Handler whose methods do nothing. Embed it in a handler to only implement
+// the methods you care about, which also keeps the handler compiling when Handler grows:
+//
+//	type joinLogger struct {
+//		registry.BaseHandler
+//	}
+//
+//	func (h *joinLogger) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+//		log.Printf("[INFO] member joined, id:%s\n", m.Id)
+//		return nil
+//	}
+type BaseHandler struct{}
+
+// OnMemberJoin does nothing.
+func (BaseHandler) OnMemberJoin(context.Context, *Member) error { return nil }
+
+// OnMemberLeave does nothing.
+func (BaseHandler) OnMemberLeave(context.Context, *Member) error { return nil }
+
+// OnMemberUpdate does nothing.
+func (BaseHandler) OnMemberUpdate(context.Context, *Member) error { return nil }
+
 // Auto-discover interface.
 type Discovery interface {
 
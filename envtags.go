@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envVar matches a ${VAR} or ${VAR:-default} reference to an environment variable.
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// SetTagsFromEnv sets whether the references to environment variables in the tag values of the
+// local member are resolved on Start, which saves the glue code of containerized deploys where
+// the identity comes from the environment:
+//
+//	member.SetTag("version", "${APP_VERSION}")
+//	member.SetTag("zone", "${AWS_ZONE:-unknown}")
+//
+// ${VAR} is required, Start fails with ErrTagEnv if VAR is not set, while ${VAR:-default}
+// resolves to default if VAR is not set. Tags loaded from the tags file are resolved too, both on
+// Start and when the file is reloaded, see SetTagsFile. A reload referencing a required variable
+// that is not set is logged and not applied. It defaults to false, and must be called before Start.
+func (s *Serf) SetTagsFromEnv(enable bool) {
+	s.tagsFromEnv = enable
+}
+
+// resolveEnvTags resolves the references to environment variables in the tag values. It returns
+// ErrTagEnv listing the required variables that are not set.
+func resolveEnvTags(tags map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(tags))
+	missing := make(map[string]struct{})
+	for k, v := range tags {
+		resolved[k] = envVar.ReplaceAllStringFunc(v, func(ref string) string {
+			match := envVar.FindStringSubmatch(ref)
+			if val, ok := os.LookupEnv(match[1]); ok {
+				return val
+			}
+			if match[2] != "" {
+				return match[3]
+			}
+			missing[match[1]] = struct{}{}
+			return ref
+		})
+	}
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %s", ErrTagEnv, strings.Join(names, ","))
+	}
+	return resolved, nil
+}
@@ -27,4 +27,42 @@ var (
 	ErrGroupNameEmpty      = Err{Code: 10001, Msg: "member group name empty"}
 	ErrParseAddrToHostPort = Err{Code: 10002, Msg: "parse addr to host and port error"}
 	ErrParsePort           = Err{Code: 10003, Msg: "parse port error"}
+	ErrProtocolVersion     = Err{Code: 10004, Msg: "serf protocol version out of range"}
+	ErrNameConflict        = Err{Code: 10005, Msg: "node name conflicts with another node"}
+	ErrHandlerPanic        = Err{Code: 10006, Msg: "handler panicked"}
+	ErrParseRegistries     = Err{Code: 10007, Msg: "malformed registry addresses"}
+	ErrNotStarted          = Err{Code: 10008, Msg: "serf is not started"}
+	ErrMemberNotFound      = Err{Code: 10009, Msg: "member not found"}
+	ErrCoordinatesDisabled = Err{Code: 10010, Msg: "coordinates are disabled"}
+	ErrCoordinateNotFound  = Err{Code: 10011, Msg: "coordinate of member not found"}
+	ErrInterface           = Err{Code: 10012, Msg: "network interface has no usable address"}
+	ErrClusterMismatch     = Err{Code: 10013, Msg: "member belongs to another cluster"}
+	ErrRejoinDisabled      = Err{Code: 10014, Msg: "rejoin after leave is disabled"}
+	ErrNotLeft             = Err{Code: 10015, Msg: "local member has not left the cluster"}
+	ErrRejoin              = Err{Code: 10016, Msg: "failed to rejoin the cluster"}
+	ErrTagsFile            = Err{Code: 10017, Msg: "malformed tags file"}
+	ErrLoopbackAdvertise   = Err{Code: 10018, Msg: "advertise address is loopback but registries are remote"}
+	ErrHandlerTimeout      = Err{Code: 10019, Msg: "handler timed out"}
+	ErrKeyring             = Err{Code: 10020, Msg: "malformed keyring file"}
+	ErrKeyRotation         = Err{Code: 10021, Msg: "key operation failed on some members"}
+	ErrNoRegistries        = Err{Code: 10022, Msg: "no registries to join on a non bootstrap node"}
+	ErrNoMember            = Err{Code: 10023, Msg: "no member available to pick"}
+	ErrGossipConfig        = Err{Code: 10024, Msg: "invalid gossip configuration"}
+	ErrShardTag            = Err{Code: 10025, Msg: "malformed shards tag"}
+	ErrShardCoverage       = Err{Code: 10026, Msg: "shards are not covered exactly once"}
+	ErrNoEncryption        = Err{Code: 10027, Msg: "gossip encryption is not configured"}
+	ErrServiceDegraded     = Err{Code: 10028, Msg: "fewer healthy members than the minimum"}
+	ErrUnexpectedShutdown  = Err{Code: 10029, Msg: "serf shut down unexpectedly"}
+	ErrTagEnv              = Err{Code: 10030, Msg: "tag references unset environment variables"}
+	ErrInvalidId           = Err{Code: 10031, Msg: "id is not a valid serf node name"}
+	ErrKVTooLarge          = Err{Code: 10032, Msg: "kv write exceeds the size limit"}
+	ErrKVFull              = Err{Code: 10033, Msg: "kv holds the maximum number of keys"}
+	ErrNotEnoughEligible   = Err{Code: 10034, Msg: "not enough eligible members to pick"}
+	ErrJitter              = Err{Code: 10035, Msg: "jitter fraction is not within [0, 1)"}
+	ErrBindAddr            = Err{Code: 10036, Msg: "malformed bind address"}
+	ErrAdvertiseAddr       = Err{Code: 10037, Msg: "malformed advertise address"}
+	ErrAdvertiseResolver   = Err{Code: 10038, Msg: "failed to resolve the advertise address"}
+	ErrPickCount           = Err{Code: 10039, Msg: "number of members to pick is negative"}
+	ErrFlushInterval       = Err{Code: 10040, Msg: "metrics flush interval is not positive"}
+	ErrReadvertise         = Err{Code: 10041, Msg: "failed to rejoin from the new advertise address"}
 )
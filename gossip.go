@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// SetGossipInterval sets how often memberlist gossips, and to how many random nodes per interval.
+// Gossiping more often or to more nodes speeds up the dissemination of membership changes at the
+// cost of bandwidth. It returns ErrGossipConfig if interval or nodes is not positive.
+// It must be called before Start, and leaves the serf defaults (200ms, 3 nodes) if not called.
+//
+// Small clusters on a LAN converge fast with the defaults, or 100ms and 3 nodes on a local
+// network. Large clusters of hundreds of nodes converge faster with 4 to 6 nodes, and clusters
+// spanning a WAN should gossip less often, 500ms with 4 nodes is a reasonable start.
+func (s *Serf) SetGossipInterval(interval time.Duration, nodes int) error {
+	if interval <= 0 {
+		return fmt.Errorf("%w: gossip interval:%s", ErrGossipConfig, interval)
+	}
+	if nodes <= 0 {
+		return fmt.Errorf("%w: gossip nodes:%d", ErrGossipConfig, nodes)
+	}
+	s.gossipInterval = interval
+	s.gossipNodes = nodes
+	return nil
+}
+
+// SetPushPullInterval sets how often memberlist performs a full state sync with a random node,
+// which repairs whatever gossip missed. Since a sync transfers the whole member list, large
+// clusters should sync less often. It returns ErrGossipConfig if interval is not positive.
+// It must be called before Start, and leaves the serf default (30s) if not called.
+//
+// Small clusters are fine with 15s to 30s, large clusters of hundreds of nodes, or clusters
+// spanning a WAN, with 60s or more.
+func (s *Serf) SetPushPullInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("%w: push/pull interval:%s", ErrGossipConfig, interval)
+	}
+	s.pushPullInterval = interval
+	return nil
+}
+
+// SetSerfConfig sets a function customizing the serf configuration, with the memberlist
+// configuration in its MemberlistConfig, right before serf is created by Start, after every
+// other option has been applied. It is the escape hatch for the serf and memberlist settings
+// the registry doesn't wrap, such as the probe timeouts or a custom transport.
+//
+// The registry owns EventCh, NodeName and Tags, which are restored after fn returns, so that
+// they can't be clobbered by accident. Change the tags with SetTag or UpdateTags instead.
+// The conflict delegate of the memberlist configuration is wrapped to detect name conflicts,
+// see SetNameConflictPolicy. It must be called before Start.
+func (s *Serf) SetSerfConfig(fn func(cfg *serf.Config)) {
+	s.configure = fn
+}
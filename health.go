@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultHealthDebounce is the default time the reported health must settle before it is gossiped.
+const DefaultHealthDebounce = time.Second
+
+// HealthStatus is the health of a member, gossiped to the cluster in the health tag.
+type HealthStatus string
+
+const (
+	HealthPass HealthStatus = "pass" // the member is healthy
+	HealthWarn HealthStatus = "warn" // the member is degraded but still serving
+	HealthFail HealthStatus = "fail" // the member is unhealthy
+)
+
+// Health returns the health gossiped by the member. A member that never reported its health is healthy.
+func (m *Member) Health() HealthStatus {
+	val, ok := m.GetTag(TagHealth)
+	if !ok || val == "" {
+		return HealthPass
+	}
+	return HealthStatus(val)
+}
+
+// healthReporter debounces the local health reports before gossiping them as a tag,
+// so that a flapping check doesn't cause a gossip storm.
+type healthReporter struct {
+	sync.Mutex
+	debounce  time.Duration // the time a reported health must settle before it is gossiped
+	pending   HealthStatus  // the latest reported health
+	published HealthStatus  // the latest gossiped health
+	timer     Timer         // the running debounce timer, nil if none
+}
+
+// SetHealthDebounce sets the time the reported health must settle before it is gossiped,
+// it defaults to DefaultHealthDebounce.
+func (s *Serf) SetHealthDebounce(d time.Duration) {
+	s.health.Lock()
+	defer s.health.Unlock()
+	s.health.debounce = d
+}
+
+// ReportHealth reports the result of a local health check. The status is published to the whole
+// cluster in the health tag once it has been stable for the debounce time, so that every node
+// converges on the same health picture through gossip.
+func (s *Serf) ReportHealth(status HealthStatus) {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	s.health.pending = status
+	if s.health.timer != nil {
+		return
+	}
+
+	debounce := s.health.debounce
+	if debounce <= 0 {
+		debounce = DefaultHealthDebounce
+	}
+	s.health.timer = s.clock.AfterFunc(debounce, s.publishHealth)
+}
+
+// stop cancels the pending health report, if any.
+func (h *healthReporter) stop() {
+	h.Lock()
+	defer h.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+}
+
+// publishHealth gossips the pending health if it differs from the published one. The health is
+// marked published before the tag update returns, which waits for the update to be broadcast,
+// so that repeated reports of the same health don't queue duplicate updates meanwhile.
+func (s *Serf) publishHealth() {
+	s.health.Lock()
+	s.health.timer = nil
+	status := s.health.pending
+	prev := s.health.published
+	if status == prev {
+		s.health.Unlock()
+		return
+	}
+	s.health.published = status
+	s.health.Unlock()
+
+	if err := s.UpdateTags(map[string]string{TagHealth: string(status)}); err != nil {
+		log.Printf("[ERROR] serf publish health:%s err:%s\n", status, err.Error())
+		s.health.Lock()
+		if s.health.published == status {
+			s.health.published = prev
+		}
+		s.health.Unlock()
+	}
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// DefaultHealthCheckTimeout is the default time a health check waits for the service to accept a connection.
+const DefaultHealthCheckTimeout = time.Second
+
+// SetHealthCheck enables an active health check of the local service, reported with ReportHealth
+// on every interval: HealthPass if the service accepts a TCP connection within timeout, HealthFail
+// otherwise. The service is dialed on the address peers derive for it, the addr tag or the result
+// of the AddressResolver, which is the port clients use rather than the gossip port, so that a
+// service that is down gets no traffic even though its node still gossips. A timeout of zero or
+// less uses DefaultHealthCheckTimeout, and an interval of zero, the default, disables the check.
+// It must be called before Start.
+func (s *Serf) SetHealthCheck(interval time.Duration, timeout time.Duration) {
+	s.checkInterval = interval
+	s.checkTimeout = timeout
+}
+
+// runHealthCheck checks the local service on every health check interval until shutdown is closed.
+func (s *Serf) runHealthCheck(shutdown <-chan struct{}) {
+	ticker := s.newTicker(s.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.ReportHealth(s.checkService())
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// checkService dials the service address peers derive for the local member.
+func (s *Serf) checkService() HealthStatus {
+	addr := s.newMember(s.serf.LocalMember()).Service.Addr
+	timeout := s.checkTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		log.Printf("[WARN] serf health check of service addr:%s failed, err:%s\n", addr, err.Error())
+		return HealthFail
+	}
+	conn.Close()
+	return HealthPass
+}
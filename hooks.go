@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+)
+
+// OnHandlerPanic sets the function called with the recovered value when a handler method panics,
+// so that callers can alert. The panic is logged and the event loop carries on with the next event.
+// It must be called before Start.
+func (s *Serf) OnHandlerPanic(fn func(recovered any)) {
+	s.onHandlerPanic = fn
+}
+
+// ReplicasChangedFunc is called when a member advertises a different number of replicas.
+type ReplicasChangedFunc func(m *Member, old int, latest int)
+
+// OnReplicasChanged sets the function called when an update changes the replicas advertised by a member.
+// Capacity changes shift the traffic distribution, this makes them visible. It must be called before Start.
+func (s *Serf) OnReplicasChanged(fn ReplicasChangedFunc) {
+	s.onReplicasChanged = fn
+}
+
+// checkReplicas reports a change of the replicas between the stored and the updated member.
+func (s *Serf) checkReplicas(prev *Member, latest *Member) {
+	if prev == nil || prev.Replicas == latest.Replicas {
+		return
+	}
+
+	old, err := strconv.Atoi(prev.Replicas)
+	if err != nil {
+		return
+	}
+	replicas, err := strconv.Atoi(latest.Replicas)
+	if err != nil {
+		return
+	}
+
+	log.Printf("[INFO] member replicas changed, id:%s, old:%d, new:%d\n", latest.Id, old, replicas)
+	if s.onReplicasChanged != nil {
+		s.onReplicasChanged(latest, old, replicas)
+	}
+}
+
+// AddressChangedFunc is called when a member advertises a different service address.
+type AddressChangedFunc func(m *Member, oldAddr string, newAddr string)
+
+// OnAddressChanged sets the function called when an update changes the service address of a
+// member, such as after it was rescheduled on another host, as opposed to an update of its other
+// tags. Connection pools can reconnect to the member precisely when they must. The service
+// address is the one derived by the address resolver, if any. It must be called before Start.
+func (s *Serf) OnAddressChanged(fn AddressChangedFunc) {
+	s.onAddressChanged = fn
+}
+
+// checkAddress reports a change of the service address between the stored and the updated member.
+func (s *Serf) checkAddress(prev *Member, latest *Member) {
+	if prev == nil || prev.Service.Addr == latest.Service.Addr {
+		return
+	}
+
+	log.Printf("[INFO] member service address changed, id:%s, old:%s, new:%s\n", latest.Id, prev.Service.Addr, latest.Service.Addr)
+	if s.onAddressChanged != nil {
+		s.onAddressChanged(latest, prev.Service.Addr, latest.Service.Addr)
+	}
+}
+
+// OnSelfFailed sets the function called when peers declare the local node failed, typically
+// because a network partition cut it off, and the node refutes it once it hears of it again.
+// The node can react, for example by stopping to serve writes, until OnSelfRejoined is called.
+// Memberlist has no delegate for refutations, so they are read from the memberlist log, which
+// a logger set with SetSerfConfig bypasses. It must be called before Start.
+func (s *Serf) OnSelfFailed(fn func()) {
+	s.onSelfFailed = fn
+}
+
+// OnSelfRejoined sets the function called when a peer gossips the local node alive again after
+// it was declared failed, which tells the refutation reached the cluster. It must be called
+// before Start.
+func (s *Serf) OnSelfRejoined(fn func()) {
+	s.onSelfRejoined = fn
+}
+
+// refuteDeadMessage is logged by memberlist when it refutes a peer declaring the local node dead.
+var refuteDeadMessage = []byte("memberlist: Refuting a dead message")
+
+// selfWatcher passes the serf and memberlist log through to the next writer, and reports the
+// refutations of the local node being declared dead.
+type selfWatcher struct {
+	serf *Serf
+	next io.Writer
+}
+
+// Write implements io.Writer.
+func (w *selfWatcher) Write(p []byte) (int, error) {
+	if bytes.Contains(p, refuteDeadMessage) {
+		w.serf.selfRefuted()
+	}
+	return w.next.Write(p)
+}
+
+// selfRefuted reports that peers declared the local node dead, and calls the self failed
+// function on the event loop. It runs on memberlist goroutines.
+func (s *Serf) selfRefuted() {
+	if s.selfFailed.Swap(true) {
+		return
+	}
+	log.Printf("[WARN] local member is declared failed by peers, id:%s\n", s.member.Id)
+	if s.onSelfFailed != nil {
+		s.queue.push(internalEvent(s.onSelfFailed))
+	}
+}
+
+// selfAlive reports an alive message of the local node gossiped by a peer, and calls the self
+// rejoined function on the event loop if the local node was declared failed. It runs on
+// memberlist goroutines.
+func (s *Serf) selfAlive() {
+	if !s.selfFailed.CompareAndSwap(true, false) {
+		return
+	}
+	log.Printf("[INFO] local member is gossiped alive again, id:%s\n", s.member.Id)
+	if s.onSelfRejoined != nil {
+		s.queue.push(internalEvent(s.onSelfRejoined))
+	}
+}
+
+// OnLoopExit sets the function called when the registry stops tracking membership. err is nil
+// when the event loop exits because of Stop, Close, Leave or a name conflict on Start, and wraps
+// ErrUnexpectedShutdown when serf shut down on its own, after which no membership change is seen
+// until a supervisor restarts the node. It must be called before Start.
+func (s *Serf) OnLoopExit(fn func(err error)) {
+	s.onLoopExit = fn
+}
+
+// watchShutdown reports serf shutting down before stop is closed without being stopped.
+func (s *Serf) watchShutdown(serfShutdown <-chan struct{}, stop chan struct{}) {
+	select {
+	case <-serfShutdown:
+	case <-stop:
+		return
+	}
+	if s.stopping.Load() {
+		return
+	}
+
+	s.unplanned.Store(true)
+	log.Printf("[ERROR] serf shut down unexpectedly, membership is no longer tracked, id:%s\n", s.member.Id)
+	if s.onLoopExit != nil {
+		s.onLoopExit(fmt.Errorf("%w, id:%s", ErrUnexpectedShutdown, s.member.Id))
+	}
+}
+
+// loopExited reports the planned exit of the event loop, an unplanned one is already reported
+// by watchShutdown.
+func (s *Serf) loopExited() {
+	if !s.unplanned.Load() && s.onLoopExit != nil {
+		s.onLoopExit(nil)
+	}
+}
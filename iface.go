@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// SetInterface binds and advertises the local member on the address of the named network
+// interface, such as "eth1", instead of the hosts of Bind and Advertise. The ports of Bind
+// and Advertise are kept. The address is resolved on Start, preferring IPv4 over IPv6,
+// which suits multi-homed hosts where the right IP isn't known at config time.
+// It must be called before Start.
+func (s *Serf) SetInterface(name string) {
+	s.iface = name
+}
+
+// bindInterface replaces the hosts of the local member's bind and advertise addresses
+// with the address of the configured network interface.
+func (s *Serf) bindInterface() error {
+	ip, err := interfaceAddr(s.iface)
+	if err != nil {
+		return err
+	}
+
+	_, port, err := s.splitHostPort(s.member.Bind)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBindAddr, s.member.Bind, err)
+	}
+	s.member.Bind = net.JoinHostPort(ip, strconv.Itoa(port))
+
+	_, port, err = s.splitHostPort(s.member.Advertise)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrAdvertiseAddr, s.member.Advertise, err)
+	}
+	s.member.Advertise = net.JoinHostPort(ip, strconv.Itoa(port))
+	return nil
+}
+
+// interfaceAddr returns the first IPv4 address of the named interface, or its first
+// IPv6 address if it has no IPv4 one. Link-local addresses are skipped.
+func interfaceAddr(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrInterface, name, err.Error())
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrInterface, name, err.Error())
+	}
+
+	var v6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if v6 == "" {
+			v6 = ipnet.IP.String()
+		}
+	}
+	if v6 == "" {
+		return "", fmt.Errorf("%w: %s has no usable address", ErrInterface, name)
+	}
+	return v6, nil
+}
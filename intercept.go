@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+)
+
+// MemberInterceptor is called with every member of a membership event before it is tracked. It
+// returns the member to track, such as a copy with normalized tags, computed fields or a rewritten
+// address, or an error to drop the member. The returned member must keep the ID of the given one.
+type MemberInterceptor func(m *Member) (*Member, error)
+
+// SetMemberInterceptor sets the single function that vetoes or transforms the discovered members
+// before they are tracked. It runs on the event loop after the address resolver, and before the
+// member cap, the handler, the storage and the subscribers, so all of them see the returned member.
+// A member dropped on a join is not tracked at all, and an update dropped for a tracked member
+// leaves its previous version in place until it changes again or leaves. A member leaving or
+// failing is passed too, a tracked member is retired even if the interceptor drops it.
+// It defaults to nil, which tracks the members as discovered, and must be called before Start.
+func (s *Serf) SetMemberInterceptor(fn MemberInterceptor) {
+	s.memberInterceptor = fn
+}
+
+// intercept passes the member of an event to the member interceptor, if it is set, and returns
+// the member to track, or nil if the interceptor dropped it. A nil member without an error keeps
+// the given one.
+func (s *Serf) intercept(latest *Member) *Member {
+	if s.memberInterceptor == nil {
+		return latest
+	}
+
+	m, err := s.memberInterceptor(latest)
+	if err != nil {
+		log.Printf("[INFO] serf member interceptor dropped member, id:%s, err:%s\n", latest.Id, err.Error())
+		return nil
+	}
+	if m == nil {
+		return latest
+	}
+	if m.Id != latest.Id {
+		log.Printf("[ERROR] serf member interceptor changed the member id, dropped member, id:%s, new id:%s\n", latest.Id, m.Id)
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultJitter is the default jitter fraction of the periodic background work.
+const DefaultJitter = 0.1
+
+// SetJitter sets the jitter fraction of the periodic background work, the health checks, the
+// stale member sweeps, the stats sampling, the tags file checks and the rejoin attempts. Every
+// period is drawn at random within the fraction of its interval, so that a fleet of nodes started
+// together doesn't synchronize into traffic spikes, while the mean period is the interval. A
+// fraction of 0.1, the default, draws the periods of a 10s interval between 9s and 11s, and a
+// fraction of zero disables the jitter, such as for tests driving a FakeClock. It returns
+// ErrJitter if the fraction is not within [0, 1). It must be called before Start.
+func (s *Serf) SetJitter(fraction float64) error {
+	if fraction < 0 || fraction >= 1 {
+		return fmt.Errorf("%w: %v", ErrJitter, fraction)
+	}
+	s.jitter = fraction
+	return nil
+}
+
+// jittered returns the interval d spread by up to the fraction of it in either direction.
+func jittered(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	spread := float64(d) * fraction
+	return d + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+// jitterTicker is a Ticker whose periods are jittered, see SetJitter. Every period is a timer of
+// the clock armed by the previous one when it fires, so a FakeClock advanced past a period fires
+// the tick within Advance.
+type jitterTicker struct {
+	sync.Mutex
+	clock    Clock
+	d        time.Duration
+	fraction float64
+	ch       chan time.Time
+	timer    Timer
+	stopped  bool
+}
+
+// newJitterTicker returns a ticker of clock sending the time on every period d jittered by the
+// fraction. Like the tickers of the time package, a tick is dropped if the previous one has not
+// been received. Without jitter it is the ticker of the clock.
+func newJitterTicker(clock Clock, d time.Duration, fraction float64) Ticker {
+	if fraction <= 0 {
+		return clock.NewTicker(d)
+	}
+	t := &jitterTicker{
+		clock:    clock,
+		d:        d,
+		fraction: fraction,
+		ch:       make(chan time.Time, 1),
+	}
+	t.arm()
+	return t
+}
+
+// arm starts the timer of the next period, unless the ticker is stopped.
+func (t *jitterTicker) arm() {
+	t.Lock()
+	defer t.Unlock()
+	if !t.stopped {
+		t.timer = t.clock.AfterFunc(jittered(t.d, t.fraction), t.tick)
+	}
+}
+
+// tick sends the time of the period that has elapsed, and arms the next one.
+func (t *jitterTicker) tick() {
+	select {
+	case t.ch <- t.clock.Now():
+	default:
+	}
+	t.arm()
+}
+
+// newTicker returns a ticker of the clock of s sending the time on every period d, jittered by
+// the jitter fraction of s.
+func (s *Serf) newTicker(d time.Duration) Ticker {
+	return newJitterTicker(s.clock, d, s.jitter)
+}
+
+// C implements Ticker.
+func (t *jitterTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop implements Ticker.
+func (t *jitterTicker) Stop() {
+	t.Lock()
+	defer t.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// SetKeyringFile sets the file persisting the gossip encryption keys. The file holds a JSON
+// array of base64 encoded keys of 16, 24 or 32 bytes, the first of which is the primary key:
+//
+//	["QHOYjmYlxSCBhdfiolhtDQ=="]
+//
+// If the file exists, its keys are loaded on Start and gossip is encrypted. The keys installed,
+// used or removed with InstallKey, UseKey and RemoveKey are written back to it, so they survive
+// restarts and rotations. Anyone able to read the file can join and decrypt the cluster, so it
+// must only be readable by the owner of the process, with 0600 permissions, which is also what
+// serf writes it with. It must be called before Start.
+func (s *Serf) SetKeyringFile(path string) {
+	s.keyringFile = path
+}
+
+// loadKeyring reads the keyring of the keyring file, it returns nil if the file doesn't exist.
+func loadKeyring(path string) (*memberlist.Keyring, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyring, err.Error())
+	}
+
+	encoded := make([]string, 0)
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrKeyring, path, err.Error())
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("%w: %s has no keys", ErrKeyring, path)
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrKeyring, path, err.Error())
+		}
+		keys = append(keys, key)
+	}
+
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrKeyring, path, err.Error())
+	}
+	return keyring, nil
+}
+
+// InstallKey installs the base64 encoded key on every member of the cluster, which is the first
+// step of a key rotation. The key is not used to encrypt until UseKey is called.
+func (s *Serf) InstallKey(key string) error {
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	resp, err := s.serf.KeyManager().InstallKey(key)
+	return keyResult("install", resp, err)
+}
+
+// UseKey makes the installed base64 encoded key the primary key on every member of the cluster.
+func (s *Serf) UseKey(key string) error {
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	resp, err := s.serf.KeyManager().UseKey(key)
+	return keyResult("use", resp, err)
+}
+
+// RemoveKey removes the base64 encoded key from every member of the cluster, which is the last
+// step of a key rotation. The primary key can't be removed.
+func (s *Serf) RemoveKey(key string) error {
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	resp, err := s.serf.KeyManager().RemoveKey(key)
+	return keyResult("remove", resp, err)
+}
+
+// EncryptionEnabled returns whether gossip is encrypted, which is the case if a keyring file
+// with keys was loaded on Start, or if keys were set with SetSerfConfig.
+func (s *Serf) EncryptionEnabled() bool {
+	return s.serf != nil && s.serf.EncryptionEnabled()
+}
+
+// PrimaryKeyFingerprint returns the fingerprint of the local primary key, see KeyFingerprint, so
+// that operators can verify the key in use after a rotation without exposing it. It returns
+// ErrNotStarted if serf is not started, and ErrNoEncryption if gossip is not encrypted.
+func (s *Serf) PrimaryKeyFingerprint() (string, error) {
+	if s.serf == nil {
+		return "", ErrNotStarted
+	}
+	if s.keyring == nil {
+		return "", ErrNoEncryption
+	}
+	return fingerprint(s.keyring.GetPrimaryKey()), nil
+}
+
+// PrimaryKeyFingerprints asks every member of the cluster for its primary key, and returns the
+// number of members using each primary key by fingerprint. A rotation has converged onto the new
+// primary key once it is the only fingerprint, and the old key can then be removed.
+// It returns ErrNotStarted if serf is not started, and ErrNoEncryption if gossip is not encrypted.
+func (s *Serf) PrimaryKeyFingerprints() (map[string]int, error) {
+	if s.serf == nil {
+		return nil, ErrNotStarted
+	}
+	if s.keyring == nil {
+		return nil, ErrNoEncryption
+	}
+	resp, err := s.serf.KeyManager().ListKeys()
+	if err := keyResult("list", resp, err); err != nil {
+		return nil, err
+	}
+
+	fingerprints := make(map[string]int, len(resp.PrimaryKeys))
+	for key, n := range resp.PrimaryKeys {
+		fp, err := KeyFingerprint(key)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints[fp] += n
+	}
+	return fingerprints, nil
+}
+
+// KeyFingerprint returns the fingerprint of a base64 encoded key, the hex encoded first 8 bytes
+// of its SHA-256 digest, which identifies the key without revealing it.
+func KeyFingerprint(key string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrKeyring, err.Error())
+	}
+	return fingerprint(data), nil
+}
+
+// fingerprint returns the fingerprint of a key.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyResult returns ErrKeyRotation listing the members that failed a key operation.
+func keyResult(op string, resp *serf.KeyResponse, err error) error {
+	if err == nil && resp.NumErr == 0 {
+		return nil
+	}
+
+	failures := make([]string, 0)
+	if resp != nil {
+		for node, msg := range resp.Messages {
+			failures = append(failures, node+": "+msg)
+		}
+		sort.Strings(failures)
+	}
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+	return fmt.Errorf("%w: %s key: %s", ErrKeyRotation, op, strings.Join(failures, ", "))
+}
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// kvEventName is the name of the serf user events carrying the KV writes.
+	kvEventName = "registry-kv"
+
+	// KVSizeLimit is the maximum size of an encoded KV write, which is the default serf
+	// limit of the user events, including the event name.
+	KVSizeLimit = 512
+
+	// DefaultKVMaxKeys is the default maximum number of keys of the KV.
+	DefaultKVMaxKeys = 1024
+)
+
+// KV is a small eventually consistent key value store shared by the members of the cluster,
+// for cluster-wide feature flags and small configuration without a separate store.
+//
+// Writes are broadcast as serf user events and applied by every member in the order of their
+// Lamport time, so members converge on the last write of a key. It is eventually consistent:
+// a write reaches the members over a few gossip rounds, and members that are not part of the
+// cluster when a key is written, such as nodes joining later, miss the write unless the key is
+// written again, or they join replaying the events, see SetReplayEvents. A write, key and value, must fit in KVSizeLimit, and the number of keys is
+// bounded, see SetKVMaxKeys. Get the KV of a Serf with Serf.KV.
+type KV struct {
+	sync.RWMutex
+	serf     *Serf
+	entries  map[string]kvEntry      // the local replica of the keys
+	maxKeys  int                     // the maximum number of keys
+	onChange func(key, value string) // the optional function called when the value of a key changes
+}
+
+// kvEntry is a value of the KV with the Lamport time of its write.
+type kvEntry struct {
+	value string
+	ltime serf.LamportTime
+}
+
+// kvWrite is the payload of a KV user event.
+type kvWrite struct {
+	Key   string `json:"k"`
+	Value string `json:"v"`
+}
+
+// newKV creates the KV of s.
+func newKV(s *Serf) *KV {
+	return &KV{
+		serf:    s,
+		entries: make(map[string]kvEntry),
+		maxKeys: DefaultKVMaxKeys,
+	}
+}
+
+// KV returns the cluster-wide key value store of the Serf.
+func (s *Serf) KV() *KV {
+	return s.kv
+}
+
+// SetKVMaxKeys sets the maximum number of keys of the KV, which bounds its memory. It defaults
+// to DefaultKVMaxKeys. Writes of new keys beyond the maximum are refused with ErrKVFull locally,
+// and dropped with a warning when they come from other members. It must be called before Start.
+func (s *Serf) SetKVMaxKeys(n int) {
+	s.kv.maxKeys = n
+}
+
+// OnKVChange sets the function called when the value of a key of the KV changes. It is called
+// by Set for the local writes, and on the event loop for the writes of other members.
+// It must be called before Start.
+func (s *Serf) OnKVChange(fn func(key, value string)) {
+	s.kv.onChange = fn
+}
+
+// Set sets the value of the key on the local replica, and broadcasts the write to the cluster.
+// It returns ErrKVTooLarge if the write doesn't fit in KVSizeLimit, ErrKVFull if the key is new
+// and the KV holds its maximum number of keys, and ErrNotStarted if serf is not started.
+func (kv *KV) Set(key string, value string) error {
+	if kv.serf.serf == nil {
+		return ErrNotStarted
+	}
+	payload, err := json.Marshal(&kvWrite{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	if size := len(kvEventName) + len(payload); size > KVSizeLimit {
+		return fmt.Errorf("%w: key:%s is %d bytes", ErrKVTooLarge, key, size)
+	}
+
+	kv.Lock()
+	entry, ok := kv.entries[key]
+	if !ok && len(kv.entries) >= kv.maxKeys {
+		kv.Unlock()
+		return fmt.Errorf("%w: key:%s", ErrKVFull, key)
+	}
+	// The write takes its Lamport time when it is delivered back by serf.
+	kv.entries[key] = kvEntry{value: value, ltime: entry.ltime}
+	kv.Unlock()
+
+	if kv.onChange != nil && (!ok || entry.value != value) {
+		kv.onChange(key, value)
+	}
+	return kv.serf.serf.UserEvent(kvEventName, payload, false)
+}
+
+// Get returns the value of the key on the local replica, and whether the key is set.
+func (kv *KV) Get(key string) (string, bool) {
+	kv.RLock()
+	defer kv.RUnlock()
+	entry, ok := kv.entries[key]
+	return entry.value, ok
+}
+
+// Keys returns the number of keys of the local replica.
+func (kv *KV) Keys() int {
+	kv.RLock()
+	defer kv.RUnlock()
+	return len(kv.entries)
+}
+
+// apply applies a KV write delivered by serf, unless a later write of the key is already applied.
+// It runs on the event loop.
+func (kv *KV) apply(e serf.UserEvent) {
+	w := &kvWrite{}
+	if err := json.Unmarshal(e.Payload, w); err != nil {
+		log.Printf("[ERROR] serf decode kv write err:%s\n", err.Error())
+		return
+	}
+
+	kv.Lock()
+	entry, ok := kv.entries[w.Key]
+	if !ok && len(kv.entries) >= kv.maxKeys {
+		kv.Unlock()
+		log.Printf("[WARN] serf kv holds the maximum of %d keys, dropped the write of key:%s\n", kv.maxKeys, w.Key)
+		return
+	}
+	// Concurrent writes of the same Lamport time are ordered by value, so every member picks the same.
+	if ok && (e.LTime < entry.ltime || (e.LTime == entry.ltime && w.Value < entry.value)) {
+		kv.Unlock()
+		return
+	}
+	kv.entries[w.Key] = kvEntry{value: w.Value, ltime: e.LTime}
+	kv.Unlock()
+
+	if kv.onChange != nil && (!ok || entry.value != w.Value) {
+		kv.onChange(w.Key, w.Value)
+	}
+}
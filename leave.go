@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// SetLeaveGrace sets how long a left or failed member is kept before it is removed.
+// During the grace window the member is still returned by Members with the StatusLeaving
+// status, so clients that just resolved it can drain, while the handler has already been
+// told about the leave and excludes it from new selections.
+// A grace of zero, the default, removes the member immediately. It must be called before Start.
+func (s *Serf) SetLeaveGrace(d time.Duration) {
+	s.leaveGrace = d
+}
+
+// SetFailedGrace sets how long a failed member is kept in the StatusSuspect status before it is
+// handled as failed. On flaky networks a failure is often transient and the member returns within
+// seconds, removing it at once causes needless failover churn. During the grace window the suspect
+// member is still selected, and neither the handler nor the subscribers hear about the failure,
+// so a member rejoining within the window causes no routing change, only an update. A member
+// that doesn't rejoin is handled as failed once the window has passed, then kept for the leave
+// grace window, if any, see SetLeaveGrace. A grace of zero, the default, handles failures
+// immediately. Graceful leaves are always handled immediately. It must be called before Start.
+func (s *Serf) SetFailedGrace(d time.Duration) {
+	s.failedGrace = d
+}
+
+// SetLeavePropagateDelay sets how long a graceful leave, by Stop or Leave, waits after
+// broadcasting the leave for it to propagate before shutting serf down. It defaults to the serf
+// default of one second. A shorter delay shuts down faster, but peers that have not heard of the
+// leave by then see the member as failed instead of left, which fast-cycling pods of a rolling
+// deploy are prone to. A longer delay makes clean leaves more reliable on large or slow networks.
+// It must be called before Start.
+func (s *Serf) SetLeavePropagateDelay(d time.Duration) {
+	s.propagateDelay = d
+	s.propagateDelaySet = true
+}
+
+// retire removes a left or failed member, or marks it as leaving and removes it
+// once the leave grace window has passed.
+func (s *Serf) retire(m *Member) {
+	if s.leaveGrace <= 0 {
+		s.deleteMember(m.Id)
+		return
+	}
+	// A member that was never stored, such as one beyond the member cap, is not kept as leaving.
+	if s.loadMember(m.Id) == nil {
+		return
+	}
+
+	m.Status = StatusLeaving
+	s.storeMember(m)
+
+	queue := s.queue
+	s.clock.AfterFunc(s.leaveGrace, func() {
+		queue.push(internalEvent(func() {
+			// The member may have rejoined during the grace window, keep the rejoined one.
+			if s.loadMember(m.Id) == m {
+				s.deleteMember(m.Id)
+			}
+		}))
+	})
+}
+
+// leave handles a left or failed member: it retires the member, calls the OnMemberLeave method of
+// the handler and notifies the subscribers.
+func (s *Serf) leave(t serf.EventType, latest *Member) {
+	seq := s.observe(t, latest)
+
+	// retire member and call handler's OnMemberLeave method if it exists
+	s.retire(latest)
+	s.recount(latest.Id, nil)
+	if err := s.dispatch(t, latest); err != nil {
+		log.Printf("[ERROR] serf handle member leave err:%s\n", err.Error())
+	}
+	if t == serf.EventMemberFailed {
+		s.subscribers.publish(MemberEvent{Type: EventFailed, Member: latest, Seq: seq}, nil)
+	} else {
+		s.subscribers.publish(MemberEvent{Type: EventLeave, Member: latest, Seq: seq}, nil)
+	}
+}
+
+// suspect keeps a failed member as suspect for the failed grace window, and handles it as failed
+// once the window has passed unless it rejoined. It returns false if the failure must be handled
+// at once, because there is no grace, the member is the local one or it is not stored.
+func (s *Serf) suspect(latest *Member) bool {
+	if s.failedGrace <= 0 || latest.Id == s.member.Id {
+		return false
+	}
+	prev := s.loadMember(latest.Id)
+	if prev == nil || prev.IsLeaving() {
+		return false
+	}
+	if prev.IsSuspect() {
+		return true
+	}
+
+	log.Printf("[INFO] failed member is kept as suspect, id:%s, grace:%s\n", latest.Id, s.failedGrace)
+	suspect := prev.Clone()
+	suspect.Status = StatusSuspect
+	s.storeMember(suspect)
+	// The failure is observed once the grace has passed, but a rejoin within it is a recovery.
+	s.trackRecovery(serf.EventMemberFailed, latest)
+
+	queue := s.queue
+	s.clock.AfterFunc(s.failedGrace, func() {
+		queue.push(internalEvent(func() {
+			// The member may have rejoined during the grace window, keep the rejoined one.
+			if s.loadMember(suspect.Id) == suspect {
+				s.leave(serf.EventMemberFailed, latest)
+			}
+		}))
+	})
+	return true
+}
@@ -0,0 +1,39 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+)
+
+// SetMaxMembers sets the maximum number of members tracked, which bounds the memory of the
+// members on a cluster much larger than provisioned for, such as one that is misconfigured.
+// A member joining beyond the maximum is not stored, nor passed to the handler or the
+// subscribers, but logged and passed to the OnMemberOverflow function instead. It is a safety
+// valve rather than a normal limit, and defaults to 0, unlimited. It must be called before Start.
+func (s *Serf) SetMaxMembers(n int) {
+	s.maxMembers = n
+}
+
+// OnMemberOverflow sets the function called with a member that is not tracked because the
+// maximum number of members is reached, see SetMaxMembers. It must be called before Start.
+func (s *Serf) OnMemberOverflow(fn func(m *Member)) {
+	s.onMemberOverflow = fn
+}
+
+// overflowed reports whether the member is new and can't be stored because the maximum number
+// of members is reached, in which case the overflow is logged and passed to the overflow function.
+func (s *Serf) overflowed(m *Member) bool {
+	if s.maxMembers <= 0 || s.size.Load() < int64(s.maxMembers) || s.loadMember(m.Id) != nil {
+		return false
+	}
+
+	log.Printf("[WARN] serf tracks the maximum of %d members, member is not stored, id:%s, advertise:%s\n",
+		s.maxMembers, m.Id, m.Advertise)
+	if s.onMemberOverflow != nil {
+		s.onMemberOverflow(m)
+	}
+	return true
+}
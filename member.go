@@ -15,6 +15,9 @@ type Service struct {
 
 	// The service address provided to the client.
 	Addr string `json:"addr"`
+
+	// Whether the service must be dialed over TLS, see TagTLS.
+	TLS bool `json:"tls,omitempty"`
 }
 
 // NewService creates a new service object.
@@ -26,6 +29,31 @@ func NewService(id string, group string, addr string) *Service {
 	}
 }
 
+// TagTLS is the optional tag key telling whether the service of a member must be dialed over
+// TLS, "true" if it does. It lets consumers pick http or https, or the gRPC transport
+// credentials, in fleets where only some members speak TLS, such as in the middle of a migration.
+const TagTLS = "tls"
+
+// TagDraining is the optional tag key telling whether a member is draining, "true" if it is, such
+// as a node about to be restarted. PickN doesn't place new work on draining members by default.
+const TagDraining = "draining"
+
+// MemberStatus is the status of a discovered member.
+type MemberStatus string
+
+const (
+	// StatusAlive is the status of a member that is part of the cluster.
+	StatusAlive MemberStatus = "alive"
+
+	// StatusLeaving is the status of a member that has left or failed and is kept
+	// for the leave grace window. It is excluded from new selections.
+	StatusLeaving MemberStatus = "leaving"
+
+	// StatusSuspect is the status of a member that failed and is kept for the failed grace
+	// window, see Serf.SetFailedGrace. Unlike a leaving member, it is still selected.
+	StatusSuspect MemberStatus = "suspect"
+)
+
 // Member is used for auto-discovery. When a service is discovered, a Member object is created.
 type Member struct {
 	sync.Mutex
@@ -33,10 +61,15 @@ type Member struct {
 	// The ID of the service.
 	Id string `json:"id"`
 
+	// The serf node name of the service. It defaults to the ID, and can differ from it
+	// where node names must be DNS-safe or unique per host while the logical ID is not.
+	Name string `json:"name"`
+
 	// The address used to register the service to the registry server.
 	Bind string `json:"bind"`
 
 	// The address that the service will advertise to the registry server.
+	// It is advertised for both the UDP and the TCP gossip transports.
 	Advertise string `json:"advertise"`
 
 	// The addresses of the registry servers. If there are more than one, separate them with commas, such as "192.168.1.101:7370,192.168.1.102:7370".
@@ -48,6 +81,9 @@ type Member struct {
 	// Service information.
 	Service Service `json:"service"`
 
+	// The status of the member.
+	Status MemberStatus `json:"status"`
+
 	// Tags for extra information.
 	tags map[string]string
 }
@@ -56,6 +92,7 @@ type Member struct {
 func NewSimpleMember(id string, bind string, advertise string) *Member {
 	return &Member{
 		Id:         id,
+		Name:       id,
 		Bind:       bind,
 		Advertise:  advertise,
 		Registries: "",
@@ -63,6 +100,7 @@ func NewSimpleMember(id string, bind string, advertise string) *Member {
 		Service: Service{
 			Id: id,
 		},
+		Status: StatusAlive,
 	}
 }
 
@@ -70,6 +108,7 @@ func NewSimpleMember(id string, bind string, advertise string) *Member {
 func NewMember(id string, bind string, advertise string, registries string, group string, addr string) *Member {
 	return &Member{
 		Id:         id,
+		Name:       id,
 		Bind:       bind,
 		Advertise:  advertise,
 		Registries: registries,
@@ -79,6 +118,7 @@ func NewMember(id string, bind string, advertise string, registries string, grou
 			Group: group,
 			Addr:  addr,
 		},
+		Status: StatusAlive,
 	}
 }
 
@@ -87,6 +127,98 @@ func (m *Member) IsSelf(b *Member) bool {
 	return m.Id == b.Id
 }
 
+// Equal returns true if the given Member object describes the same member as this Member object,
+// with the same addresses, service, status and tags. The registries are not compared, as they
+// are not gossiped.
+func (m *Member) Equal(b *Member) bool {
+	if m == b {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+
+	m.Lock()
+	same := m.Id == b.Id && m.Name == b.Name && m.Bind == b.Bind && m.Advertise == b.Advertise &&
+		m.Replicas == b.Replicas && m.Service == b.Service && m.Status == b.Status
+	tags := m.copyTags()
+	m.Unlock()
+	if !same {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if len(tags) != len(b.tags) {
+		return false
+	}
+	for k, v := range tags {
+		if val, ok := b.tags[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of this Member object, which is not changed by later tag updates of
+// this Member object, such as those of the local member.
+func (m *Member) Clone() *Member {
+	m.Lock()
+	defer m.Unlock()
+	return &Member{
+		Id:         m.Id,
+		Name:       m.Name,
+		Bind:       m.Bind,
+		Advertise:  m.Advertise,
+		Registries: m.Registries,
+		Replicas:   m.Replicas,
+		Service:    m.Service,
+		Status:     m.Status,
+		tags:       m.copyTags(),
+	}
+}
+
+// copyTags returns a copy of the tags, it must be called with the lock held.
+func (m *Member) copyTags() map[string]string {
+	tags := make(map[string]string, len(m.tags))
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// IsLeaving returns true if the member has left or failed and is only kept for the leave grace window.
+func (m *Member) IsLeaving() bool {
+	return m.Status == StatusLeaving
+}
+
+// IsSuspect returns true if the member failed and is kept for the failed grace window, callers
+// may give it less traffic.
+func (m *Member) IsSuspect() bool {
+	return m.Status == StatusSuspect
+}
+
+// IsDraining returns true if the member advertises that it is draining, see TagDraining.
+func (m *Member) IsDraining() bool {
+	val, ok := m.GetTag(TagDraining)
+	return ok && val == "true"
+}
+
+// UsesTLS returns true if the member advertises that its service must be dialed over TLS.
+func (m *Member) UsesTLS() bool {
+	val, ok := m.GetTag(TagTLS)
+	return ok && val == "true"
+}
+
+// Scheme returns the URL scheme to reach the service of the member over HTTP, "https" if it
+// uses TLS and "http" otherwise.
+func (m *Member) Scheme() string {
+	if m.UsesTLS() {
+		return "https"
+	}
+	return "http"
+}
+
 // SetTag sets the extra information associated with the given tag for this Member object.
 func (m *Member) SetTag(key string, val string) {
 	m.Lock()
@@ -107,6 +239,8 @@ func (m *Member) SetTag(key string, val string) {
 		m.Service.Group = val
 	} else if key == TagReplicas {
 		m.Replicas = val
+	} else if key == TagTLS {
+		m.Service.TLS = val == "true"
 	}
 }
 
@@ -125,21 +259,30 @@ func (m *Member) GetTag(key string) (string, bool) {
 	return val, ok
 }
 
-// SetTags set tags for this service
+// SetTags set tags for this service. The tags that are not given keep their values, and so do
+// the service attributes they describe, so a nil or empty map leaves the member unchanged.
 func (m *Member) SetTags(tags map[string]string) {
-	if m.tags == nil {
-		m.tags = make(map[string]string)
+	// Set each tag using SetTag method, which also updates the service attributes.
+	for k, v := range tags {
+		m.SetTag(k, v)
 	}
+}
+
+// replaceTags replaces all tags of this Member object with a copy of the given tags.
+func (m *Member) replaceTags(tags map[string]string) {
+	m.Lock()
+	defer m.Unlock()
 
-	// Set each tag using SetTag method.
+	m.tags = make(map[string]string, len(tags))
 	for k, v := range tags {
-		m.SetTag(k, v)
+		m.tags[k] = v
 	}
 
 	// Update service attributes based on specific tags.
-	m.Service.Group, _ = m.GetTag(TagGroup)
-	m.Service.Addr, _ = m.GetTag(TagAddr)
-	m.Replicas, _ = m.GetTag(TagReplicas)
+	m.Service.Group = m.tags[TagGroup]
+	m.Service.Addr = m.tags[TagAddr]
+	m.Replicas = m.tags[TagReplicas]
+	m.Service.TLS = m.tags[TagTLS] == "true"
 }
 
 // GetTags retrieves all tags and their values for this Member object.
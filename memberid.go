@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// validId matches the ids that are safe as serf node names, which serf restricts to
+// alphanumerics, dashes and dots of at most 128 characters when it validates node names.
+var validId = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,128}$`)
+
+// ValidateId returns ErrInvalidId if the id is not safe as a serf node name.
+func ValidateId(id string) error {
+	if !validId.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidId, id)
+	}
+	return nil
+}
+
+// NewMemberFromHostname creates a simple Member object whose ID is the hostname, which is the
+// pod name in Kubernetes, so that every host gets a distinct ID without configuration.
+// It returns ErrInvalidId if the hostname is not safe as a serf node name.
+func NewMemberFromHostname(bind string, advertise string) (*Member, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidId, err.Error())
+	}
+	if err := ValidateId(hostname); err != nil {
+		return nil, err
+	}
+	return NewSimpleMember(hostname, bind, advertise), nil
+}
+
+// NewMemberWithUUID creates a simple Member object whose ID is a random version 4 UUID, for
+// processes without a stable identity. The ID changes on every call, so a restarted process
+// joins as a new member.
+func NewMemberWithUUID(bind string, advertise string) *Member {
+	return NewSimpleMember(newUUID(), bind, advertise)
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// MergeFunc is called with the members of a cluster this node is about to merge with, when it
+// joins the cluster or another node joins it. Returning an error vetoes the merge, and the
+// members are not added.
+type MergeFunc func(members []*Member) error
+
+// SetMergeFunc sets the function that can veto merging with a cluster based on the metadata of
+// its members, such as a cluster tag, which prevents cross-cluster joins when seed lists overlap.
+// It must be called before Start.
+func (s *Serf) SetMergeFunc(fn MergeFunc) {
+	s.mergeFunc = fn
+}
+
+// SetClusterId sets the id of the cluster the local member belongs to. It is gossiped as the
+// reserved cluster_id tag, and members with a different or no cluster id are rejected when
+// merging, so a mistyped seed can't bridge two clusters sharing a subnet. An empty id, the
+// default, accepts every member. It must be called before Start.
+func (s *Serf) SetClusterId(id string) {
+	s.clusterId = id
+}
+
+// checkCluster returns ErrClusterMismatch if a member doesn't belong to the local cluster.
+func (s *Serf) checkCluster(members []*Member) error {
+	if s.clusterId == "" {
+		return nil
+	}
+	for _, m := range members {
+		if id, _ := m.GetTag(TagClusterId); id != s.clusterId {
+			return fmt.Errorf("%w: member %s has cluster id %q, expected %q", ErrClusterMismatch, m.Id, id, s.clusterId)
+		}
+	}
+	return nil
+}
+
+// mergeDelegate passes the merges of serf to the cluster id check and the merge function, and
+// checks the accepted members claiming the local node name, see aliveDelegate.
+type mergeDelegate struct {
+	serf *Serf
+}
+
+// NotifyMerge implements serf.MergeDelegate.
+func (d *mergeDelegate) NotifyMerge(members []*serf.Member) error {
+	latest := make([]*Member, 0, len(members))
+	for _, member := range members {
+		latest = append(latest, d.serf.newMember(*member))
+	}
+	if err := d.serf.checkCluster(latest); err != nil {
+		log.Printf("[WARN] serf merge with %d members rejected, err:%s\n", len(members), err.Error())
+		return err
+	}
+	if d.serf.mergeFunc != nil {
+		if err := d.serf.mergeFunc(latest); err != nil {
+			log.Printf("[WARN] serf merge with %d members vetoed, err:%s\n", len(members), err.Error())
+			return err
+		}
+	}
+	for _, member := range members {
+		d.serf.checkAlive(member)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import "time"
+
+// Names of the metrics reported by the registry.
+const (
+	MetricMemberJoin      = "member_join_total"             // counter of member join events
+	MetricMemberLeft      = "member_left_total"             // counter of members leaving for good
+	MetricMemberFailed    = "member_failed_total"           // counter of member failed events, which may recover
+	MetricMemberRecovered = "member_recovered_total"        // counter of failed members rejoining
+	MetricHandlerDispatch = "handler_dispatch"              // timer of handler calls
+	MetricHandlerDuration = "handler_duration"              // histogram prefix of handler calls per method, see HandlerMetrics
+	MetricEventOverflow   = "event_queue_overflow_total"    // counter of events queued above the high water mark
+	MetricConvergence     = "member_convergence"            // timer of the gossip convergence latency of joins
+	MetricConvergenceSkew = "member_convergence_skew_total" // counter of convergence samples skewed to zero or less
+	MetricAuditDropped    = "audit_dropped_total"           // counter of audit records dropped on a full queue, see SetAuditWriter
+
+	MetricClusterMembers     = "cluster_members"      // gauge of the members known to serf
+	MetricClusterFailed      = "cluster_failed"       // gauge of the failed members
+	MetricClusterLeft        = "cluster_left"         // gauge of the left members
+	MetricClusterHealthScore = "cluster_health_score" // gauge of the local health score
+	MetricClusterIntentQueue = "cluster_intent_queue" // gauge of the queued membership intents
+	MetricClusterEventQueue  = "cluster_event_queue"  // gauge of the queued user events
+	MetricClusterQueryQueue  = "cluster_query_queue"  // gauge of the queued queries
+
+	MetricGroupMembers   = "group_members"   // gauge prefix of the members per group, see CountMetrics
+	MetricServiceMembers = "service_members" // gauge prefix of the members per service, see CountMetrics
+)
+
+// Metrics is a sink of the metrics reported by the registry.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+
+	// IncrCounter increments the counter of the given name by delta.
+	IncrCounter(name string, delta int64)
+
+	// SetGauge sets the gauge of the given name to value.
+	SetGauge(name string, value float64)
+
+	// ObserveDuration records a timing sample of the given name.
+	ObserveDuration(name string, d time.Duration)
+}
+
+// HandlerMetrics is implemented by the metrics sinks that record the duration of the handler
+// calls per method, such as OnMemberJoin, as a histogram. It tells whether slow handlers are
+// the bottleneck of the membership convergence.
+type HandlerMetrics interface {
+
+	// ObserveHandlerDuration records the duration of a call of the handler method.
+	ObserveHandlerDuration(method string, d time.Duration)
+}
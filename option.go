@@ -29,6 +29,10 @@ type Option struct {
 
 	// Advertise is the address that will be advertised to clients for service discovery.
 	Advertise string
+
+	// LoadFactor is the bound of the load of a service relative to the mean load of its group,
+	// see Registry.MatchBounded. It must be greater than 1.
+	LoadFactor float64
 }
 
 // IOption represents a function that modifies the Option.
@@ -84,6 +88,16 @@ func OptRegistries(registries string) IOption {
 	}
 }
 
+// OptLoadFactor sets the bound of the load of a service relative to the mean load of its group
+// option, see Registry.MatchBounded. Factors not greater than 1 are ignored.
+func OptLoadFactor(factor float64) IOption {
+	return func(o *Option) {
+		if factor > 1 {
+			o.LoadFactor = factor
+		}
+	}
+}
+
 // DefaultOption returns the default options for registering a server.
 func DefaultOption() *Option {
 	hostname, _ := os.Hostname()
@@ -91,5 +105,6 @@ func DefaultOption() *Option {
 		Id:            hostname + "-" + xid.New().String(),
 		Bind:          ":7370",
 		BindAdvertise: ":7370",
+		LoadFactor:    DefaultLoadFactor,
 	}
 }
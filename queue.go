@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// eventQueueHighWater is the queue length above which pushed events are counted as overflows.
+const eventQueueHighWater = 1024
+
+// eventQueue is an unbounded FIFO of serf events. Pushing never blocks,
+// which decouples serf event delivery from the speed of the handler.
+type eventQueue struct {
+	sync.Mutex
+	events []serf.Event  // the queued events
+	ready  chan struct{} // signalled when events are pushed or the queue is closed
+	closed bool          // whether the queue is closed
+}
+
+// newEventQueue creates an empty event queue.
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		events: make([]serf.Event, 0),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push appends an event to the queue and returns the queue length after the push.
+func (q *eventQueue) push(e serf.Event) int {
+	q.Lock()
+	q.events = append(q.events, e)
+	n := len(q.events)
+	q.Unlock()
+	q.signal()
+	return n
+}
+
+// pop removes and returns the oldest event, blocking until one is available.
+// It returns false once the queue is closed and all events have been popped.
+func (q *eventQueue) pop() (serf.Event, bool) {
+	for {
+		q.Lock()
+		if len(q.events) > 0 {
+			e := q.events[0]
+			q.events[0] = nil
+			q.events = q.events[1:]
+			q.Unlock()
+			return e, true
+		}
+		if q.closed {
+			q.Unlock()
+			return nil, false
+		}
+		q.Unlock()
+		<-q.ready
+	}
+}
+
+// close closes the queue, the events already queued can still be popped.
+func (q *eventQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.signal()
+}
+
+// signal wakes up a blocked pop without blocking the caller.
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// DefaultReconnectInterval is the default interval of the attempts of serf to reconnect to the
+// failed members, the serf default.
+const DefaultReconnectInterval = 30 * time.Second
+
+// SetReconnectInterval sets how often serf attempts to reconnect to the failed members, it
+// defaults to DefaultReconnectInterval. It must be called before Start.
+func (s *Serf) SetReconnectInterval(d time.Duration) {
+	s.reconnectInterval = d
+}
+
+// OnReconnecting sets the function called with the ID of every failed member serf is still
+// trying to reconnect to, once per reconnect interval, see SetReconnectInterval. It makes the
+// members in limbo visible, between failing and either rejoining or being reaped, which serf
+// does after its ReconnectTimeout of 24 hours. It is called on the event loop, so it must not
+// block. It must be called before Start.
+func (s *Serf) OnReconnecting(fn func(id string)) {
+	s.onReconnecting = fn
+}
+
+// runReconnectWatcher queues a report of the failed members on the event loop on every reconnect
+// interval until shutdown is closed.
+func (s *Serf) runReconnectWatcher(shutdown <-chan struct{}) {
+	interval := s.reconnectInterval
+	if interval <= 0 {
+		interval = DefaultReconnectInterval
+	}
+	ticker := s.newTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.queue.push(internalEvent(s.reportReconnecting))
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// reportReconnecting calls the OnReconnecting function for every member serf reports as failed.
+func (s *Serf) reportReconnecting() {
+	for _, member := range s.serf.Members() {
+		if member.Status != serf.StatusFailed {
+			continue
+		}
+		s.onReconnecting(memberId(member))
+	}
+}
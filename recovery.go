@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// recoveryWindow is how long a failed member is remembered, a join within it counts as a recovery.
+const recoveryWindow = 10 * time.Minute
+
+// trackRecovery remembers the failed members, and returns true when a join event is the
+// recovery of a member that failed within the recovery window, or an update event is the
+// rejoin of a suspect member. It runs on the event loop.
+func (s *Serf) trackRecovery(t serf.EventType, m *Member) bool {
+	now := s.clock.Now()
+	switch t {
+	case serf.EventMemberFailed:
+		if s.failedAt == nil {
+			s.failedAt = make(map[string]time.Time)
+		}
+		for id, at := range s.failedAt {
+			if now.Sub(at) > recoveryWindow {
+				delete(s.failedAt, id)
+			}
+		}
+		s.failedAt[m.Id] = now
+
+	case serf.EventMemberLeave:
+		// A member that leaves after failing is gone, rather than recovering.
+		delete(s.failedAt, m.Id)
+
+	case serf.EventMemberJoin, serf.EventMemberUpdate:
+		at, ok := s.failedAt[m.Id]
+		if !ok {
+			return false
+		}
+		delete(s.failedAt, m.Id)
+		return now.Sub(at) <= recoveryWindow
+	}
+	return false
+}
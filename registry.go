@@ -1,7 +1,9 @@
 package registry
 
 import (
+	"context"
 	"log"
+	"sort"
 	"strconv"
 
 	"github.com/werbenhu/chash"
@@ -12,11 +14,17 @@ const (
 	DefaultReplicas = "10000"          // Default number of replicas to virtualize a service
 )
 
+// RingChangeFunc is called after the consistent hash ring of a group is rebuilt.
+// old and latest are the services on the ring before and after the change, sorted by ID.
+type RingChangeFunc func(group string, old []*Service, latest []*Service)
+
 // Registry is the registry server object
 type Registry struct {
-	opt  *Option
-	serf Discovery
-	api  Api
+	opt          *Option
+	serf         Discovery
+	api          Api
+	onRingChange RingChangeFunc
+	bounded      boundedLoads
 }
 
 // New creates a new registry object that can start a registry server when calling Serve().
@@ -66,27 +74,89 @@ func (s *Registry) Close() {
 		s.api.Stop()
 	}
 	chash.RemoveAllGroup() // Remove all groups from chash
+	s.bounded.Lock()
+	s.bounded.rings = nil
+	s.bounded.loads = nil
+	s.bounded.Unlock()
 	log.Printf("[DEBUG] registry server is closed.\n")
 }
 
+// OnRingChange sets the function called after a group's hash ring is rebuilt on a join, update or leave.
+// It lets stateful consumers, such as cache layers, react to keys moving between services.
+func (s *Registry) OnRingChange(fn RingChangeFunc) {
+	s.onRingChange = fn
+}
+
+// ringServices returns the services of a group before a change, for notifyRingChange. It returns
+// nil without decoding the services if no ring change function is set.
+func (s *Registry) ringServices(group string) []*Service {
+	if s.onRingChange == nil {
+		return nil
+	}
+	return s.Members(group)
+}
+
+// notifyRingChange calls the ring change function, if any, with the services before and after a
+// change. It is not called if the change leaves the services unchanged, such as most updates.
+func (s *Registry) notifyRingChange(group string, old []*Service) {
+	if s.onRingChange == nil {
+		return
+	}
+	latest := s.Members(group)
+	sortServices(old)
+	sortServices(latest)
+	if sameServices(old, latest) {
+		return
+	}
+	s.onRingChange(group, old, latest)
+}
+
+// sameServices returns whether two sorted lists of services are equal.
+func sameServices(a []*Service, b []*Service) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortServices sorts services by ID.
+func sortServices(services []*Service) {
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Id < services[j].Id
+	})
+}
+
 // OnMemberJoin is triggered when a new service is registered
-func (s *Registry) OnMemberJoin(m *Member) error {
+func (s *Registry) OnMemberJoin(ctx context.Context, m *Member) error {
 	log.Printf("[INFO] a new member joined, id:%s, bind:%s, group:%s, service:%s\n",
 		m.Id, m.Bind, m.Service.Group, m.Service.Addr)
+	// A call the serf abandoned on its handler timeout must not insert the vetoed member.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return s.insert(m)
 }
 
 // OnMemberLeave is triggered when a service leaves
-func (s *Registry) OnMemberLeave(m *Member) error {
+func (s *Registry) OnMemberLeave(ctx context.Context, m *Member) error {
 	log.Printf("[INFO] a new member left, id:%s, bind:%s, group:%s, service:%s\n",
 		m.Id, m.Bind, m.Service.Group, m.Service.Addr)
 	return s.delete(m)
 }
 
 // OnMemberUpdate is triggered when a service is updated
-func (s *Registry) OnMemberUpdate(m *Member) error {
+func (s *Registry) OnMemberUpdate(ctx context.Context, m *Member) error {
 	log.Printf("[INFO] a new member updated, id:%s, bind:%s, group:%s, service:%s\n",
 		m.Id, m.Bind, m.Service.Group, m.Service.Addr)
+	// A call the serf abandoned on its handler timeout must not insert the vetoed member.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return s.insert(m)
 }
 
@@ -101,10 +171,13 @@ func (s *Registry) delete(m *Member) error {
 		return ErrReplicasParam
 	}
 
+	old := s.ringServices(m.Service.Group)
 	group, _ := chash.CreateGroup(m.Service.Group, replicas)
 	if err := group.Delete(m.Service.Id); err != nil {
 		return err
 	}
+	s.ringChanged(m.Service.Group, m.Service.Id, true)
+	s.notifyRingChange(m.Service.Group, old)
 	return nil
 }
 
@@ -124,10 +197,13 @@ func (s *Registry) insert(m *Member) error {
 		return err
 	}
 
+	old := s.ringServices(m.Service.Group)
 	group, _ := chash.CreateGroup(m.Service.Group, replicas)
 	if err := group.Upsert(m.Service.Id, payload); err != nil {
 		return err
 	}
+	s.ringChanged(m.Service.Group, m.Service.Id, false)
+	s.notifyRingChange(m.Service.Group, old)
 	return nil
 }
 
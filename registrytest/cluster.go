@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+// Package registrytest provides an in-process cluster of registry nodes for tests, like
+// net/http/httptest does for HTTP servers.
+package registrytest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/werbenhu/registry"
+)
+
+const (
+	// Group is the group of the members of a test cluster.
+	Group = "test_group"
+
+	// JoinTimeout is how long StartTestCluster waits for the nodes to see each other.
+	JoinTimeout = 10 * time.Second
+
+	// startAttempts is the number of ports tried for a node, in case another process takes
+	// the free port between its allocation and the start of the node.
+	startAttempts = 3
+)
+
+// Option configures a node of a test cluster before it is started, i is the index of the node.
+type Option func(i int, s *registry.Serf)
+
+// StartTestCluster starts n nodes on loopback addresses with free ports, joins them into one
+// cluster and waits until every node sees all the others. The members have the IDs "node-0" to
+// "node-<n-1>" in the group Group, and their service address is their bind address. The nodes
+// are stopped when the test ends. The test fails if the cluster can't be formed.
+func StartTestCluster(t testing.TB, n int, opts ...Option) []*registry.Serf {
+	t.Helper()
+
+	nodes := make([]*registry.Serf, 0, n)
+	t.Cleanup(func() {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			nodes[i].Stop()
+		}
+	})
+
+	seed := ""
+	for i := 0; i < n; i++ {
+		node, addr, err := startNode(i, seed, opts)
+		if err != nil {
+			t.Fatalf("start node-%d of the test cluster err:%s", i, err.Error())
+		}
+		if i == 0 {
+			seed = addr
+		}
+		nodes = append(nodes, node)
+	}
+
+	deadline := time.Now().Add(JoinTimeout)
+	for _, node := range nodes {
+		for len(node.Members()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("test cluster didn't converge within %s, %s sees %d of %d members",
+					JoinTimeout, node.LocalMember().Id, len(node.Members()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nodes
+}
+
+// startNode starts the node of index i joining the seed, retrying on another port if the port
+// is taken. It returns the node and its address.
+func startNode(i int, seed string, opts []Option) (*registry.Serf, string, error) {
+	var err error
+	for attempt := 0; attempt < startAttempts; attempt++ {
+		var port int
+		if port, err = FreePort(); err != nil {
+			continue
+		}
+
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		node := registry.NewSerf(registry.NewMember("node-"+strconv.Itoa(i), addr, addr, seed, Group, addr))
+		for _, opt := range opts {
+			opt(i, node)
+		}
+		if err = node.Start(); err == nil {
+			return node, addr, nil
+		}
+		node.Stop()
+	}
+	return nil, "", err
+}
+
+// FreePort returns a loopback port that is free for both TCP and UDP, as gossip uses both.
+func FreePort() (int, error) {
+	for attempt := 0; attempt < startAttempts; attempt++ {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := tcp.Addr().(*net.TCPAddr).Port
+
+		udp, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		tcp.Close()
+		if err != nil {
+			continue
+		}
+		udp.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no port free for both tcp and udp")
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// DefaultRejoinInterval is the default interval between the join attempts of Rejoin.
+	DefaultRejoinInterval = time.Second
+
+	// DefaultRejoinAttempts is the default number of join attempts of Rejoin.
+	DefaultRejoinAttempts = 3
+)
+
+// SetRejoinAfterLeave sets whether a node that left the cluster with Leave may rejoin it with
+// Rejoin, without constructing a new Serf. It is also passed to serf, which only uses it when a
+// snapshot is configured with SetSerfConfig, as the registry doesn't set one. It defaults to
+// false, and must be called before Start.
+func (s *Serf) SetRejoinAfterLeave(enable bool) {
+	s.rejoinAfterLeave = enable
+}
+
+// SetRejoinInterval sets the interval between the attempts of Rejoin to join the registries,
+// and the maximum number of attempts. They default to DefaultRejoinInterval and DefaultRejoinAttempts.
+func (s *Serf) SetRejoinInterval(interval time.Duration, attempts int) {
+	s.rejoinInterval = interval
+	s.rejoinAttempts = attempts
+}
+
+// Leave gracefully leaves the cluster and stops serf, but keeps the Serf so that it can
+// rejoin the cluster with Rejoin if SetRejoinAfterLeave is enabled. The other members are
+// forgotten, with a leave passed to the handler and the subscribers for each of them, as the
+// node no longer hears about them. Rejoin discovers the members of the cluster again.
+func (s *Serf) Leave() error {
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	s.stopping.Store(true)
+	if err := s.serf.Leave(); err != nil {
+		return err
+	}
+	if err := s.serf.Shutdown(); err != nil {
+		return err
+	}
+	<-s.serf.ShutdownCh()
+	s.stopLoop()
+	s.forgetMembers()
+	log.Printf("[INFO] Serf left the cluster, id:%s\n", s.member.Id)
+	return nil
+}
+
+// forgetMembers removes the members other than the local one once the event loop has exited
+// after a leave, so that neither the members nor the handler keep the view from before the leave,
+// and members departing while the node is out don't stay tracked after Rejoin. Members that are
+// already leaving have been reported and are only removed.
+func (s *Serf) forgetMembers() {
+	for _, m := range s.Members() {
+		if m.Id == s.member.Id {
+			continue
+		}
+		if m.IsLeaving() {
+			s.deleteMember(m.Id)
+			continue
+		}
+		s.evict(m)
+	}
+}
+
+// Rejoin starts serf again after Leave and joins the registries, retrying on the rejoin
+// interval until a registry is reached or the rejoin attempts are exhausted. If no registry is
+// reached, serf is shut down again and ErrRejoin is returned, which leaves the node as after
+// Leave, so the caller can call Rejoin again later, or Stop. It returns ErrRejoinDisabled unless SetRejoinAfterLeave is enabled, and ErrNotLeft if
+// the local member is still part of the cluster.
+func (s *Serf) Rejoin() error {
+	if !s.rejoinAfterLeave {
+		return ErrRejoinDisabled
+	}
+	if s.serf == nil {
+		return ErrNotStarted
+	}
+	if s.serf.State() != serf.SerfShutdown {
+		return ErrNotLeft
+	}
+	return s.rejoin()
+}
+
+// rejoin starts serf again after Leave and joins the registries with the rejoin retries, and
+// leaves again if no registry is reached.
+func (s *Serf) rejoin() error {
+	if err := s.start(false); err != nil {
+		return err
+	}
+	registries, _ := s.parseRegistries(s.member.Registries)
+	if len(registries) == 0 {
+		return nil
+	}
+
+	interval := s.rejoinInterval
+	if interval <= 0 {
+		interval = DefaultRejoinInterval
+	}
+	attempts := s.rejoinAttempts
+	if attempts <= 0 {
+		attempts = DefaultRejoinAttempts
+	}
+
+	// Start has made the first attempt, a member count above one means it reached a registry.
+	var err error
+	for attempt := 1; s.serf.NumNodes() <= 1; attempt++ {
+		if attempt >= attempts {
+			if lerr := s.Leave(); lerr != nil {
+				log.Printf("[WARN] Serf leave after a failed rejoin err:%s\n", lerr.Error())
+			}
+			return fmt.Errorf("%w: after %d attempts: %v", ErrRejoin, attempts, err)
+		}
+		<-s.clock.After(jittered(interval, s.jitter))
+		if err = s.Join(registries); err != nil {
+			log.Printf("[WARN] Serf rejoin attempt %d failed, err:%s\n", attempt+1, err.Error())
+		}
+	}
+	log.Printf("[INFO] Serf rejoined the cluster, id:%s\n", s.member.Id)
+	return nil
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import "sync"
+
+// MembersReplacedFunc is called with the members before and after a change of the members.
+type MembersReplacedFunc func(prev []*Member, cur []*Member)
+
+// membersSnapshot is the last snapshot of the members passed to the members replaced function.
+type membersSnapshot struct {
+	sync.Mutex
+	members []*Member
+}
+
+// OnMembersReplaced sets the function called with the previous and the current members on every
+// change of the members, such as a join, an update or a removal, for consumers that reconcile
+// derived indexes against the whole state instead of applying deltas, see Diff. Both lists are
+// sorted by ID, and prev is always the cur of the previous call, so no change is missed or seen
+// twice. The lists are snapshots owned by the function, the local member is cloned into them as
+// its tags are updated in place. The function is called synchronously after the change, mostly
+// on the event loop, so it must not block. It must be called before Start.
+func (s *Serf) OnMembersReplaced(fn MembersReplacedFunc) {
+	s.onMembersReplaced = fn
+}
+
+// replaced takes a snapshot of the members after a change and passes it with the previous one
+// to the members replaced function, if it is set. Changes racing each other may be folded into
+// one snapshot, and a snapshot equal to the previous one is not reported.
+func (s *Serf) replaced() {
+	if s.onMembersReplaced == nil {
+		return
+	}
+
+	snap := &s.snapshot
+	snap.Lock()
+	defer snap.Unlock()
+
+	cur := s.Members()
+	for i, m := range cur {
+		if m == s.member {
+			cur[i] = m.Clone()
+		}
+	}
+	sortById(cur)
+	if sameSnapshot(snap.members, cur) {
+		return
+	}
+
+	prev := snap.members
+	if prev == nil {
+		prev = make([]*Member, 0)
+	}
+	snap.members = cur
+	s.onMembersReplaced(prev, cur)
+}
+
+// sameSnapshot returns true if the snapshots hold equal members, see Member.Equal.
+func sameSnapshot(a []*Member, b []*Member) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
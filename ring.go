@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/werbenhu/chash"
+)
+
+// ringPoint is a virtual node of a service on the consistent hash ring.
+type ringPoint struct {
+	hash uint32
+	id   string
+}
+
+// RingOwnership returns the fraction of the keyspace each service of the group owns on the
+// consistent hash ring, by service ID. The fractions add up to 1, and show whether the replicas
+// translate into the expected key distribution. It returns an empty map if the group has no services.
+func (s *Registry) RingOwnership(groupName string) map[string]float64 {
+	ownership := make(map[string]float64)
+	group, err := chash.GetGroup(groupName)
+	if err != nil {
+		return ownership
+	}
+
+	points := ringPoints(group)
+	if len(points) == 0 {
+		return ownership
+	}
+
+	// A key matches the last point at or before its hash, so a point owns the arc up to the next
+	// point, and the last point also owns the arc wrapping around to the first one.
+	const keyspace = float64(math.MaxUint32) + 1
+	for i, p := range points {
+		var arc float64
+		if i+1 < len(points) {
+			arc = float64(points[i+1].hash - p.hash)
+		} else {
+			arc = keyspace - float64(p.hash) + float64(points[0].hash)
+		}
+		ownership[p.id] += arc / keyspace
+	}
+	return ownership
+}
+
+// ringPoints rebuilds the ring of the group the way chash does, each service has the replicas of
+// the group as virtual nodes. The points are sorted by hash.
+func ringPoints(group *chash.Group) []ringPoint {
+	points := make([]ringPoint, 0)
+	for _, element := range group.GetElements() {
+		for i := 0; i < group.NumberOfReplicas; i++ {
+			virtualKey := strconv.Itoa(i) + element.Key
+			points = append(points, ringPoint{hash: crc32.ChecksumIEEE([]byte(virtualKey)), id: element.Key})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	return points
+}
+
+// Owner returns the member owning the key on the consistent hash ring of the group, which is
+// the member Match assigns the key to, without routing to it.
+func (s *Registry) Owner(groupName string, key string) (*Member, error) {
+	group, err := chash.GetGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, payload, err := group.Match(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Member{}
+	if err := m.Unmarshal(payload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
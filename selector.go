@@ -0,0 +1,370 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// intner is a source of random numbers in [0, n).
+type intner interface {
+	Intn(n int) int
+}
+
+// globalRand is the intner of the global source of math/rand.
+type globalRand struct{}
+
+// Intn implements intner.
+func (globalRand) Intn(n int) int { return rand.Intn(n) }
+
+// PickExcept returns a random member of the group, skipping the leaving members and the members
+// whose ID is excluded. A retry loop can exclude the members that already failed, without
+// changing what other callers pick. It returns ErrNoMember if no member is left to pick, and
+// ErrServiceDegraded if the group has too few healthy members, see SetMinHealthy.
+func (s *Serf) PickExcept(group string, exclude ...string) (*Member, error) {
+	return s.pickExcept(globalRand{}, group, exclude)
+}
+
+// PickWeighted returns a random member of the group, with a probability proportional to its
+// replicas. Leaving members and members whose replicas are not a positive number are skipped.
+// It returns ErrNoMember if there is no member to pick, and ErrServiceDegraded if the group has
+// too few healthy members, see SetMinHealthy.
+func (s *Serf) PickWeighted(group string) (*Member, error) {
+	return s.pickWeighted(globalRand{}, group)
+}
+
+// PickFlag controls which members PickNWith may pick.
+type PickFlag int
+
+const (
+	// PickIncludeDraining lets draining members count toward n, see TagDraining. They are only
+	// picked when there are not enough members that are not draining.
+	PickIncludeDraining PickFlag = 1 << iota
+
+	// PickIncludeUnhealthy lets members reporting HealthFail count toward n.
+	PickIncludeUnhealthy
+)
+
+// PickN returns n distinct random members of the group, such as the replicas of a write,
+// skipping the leaving, draining and unhealthy members, so that a write quorum isn't placed on
+// nodes about to leave. It is PickNWith without flags.
+func (s *Serf) PickN(group string, n int) ([]*Member, error) {
+	return s.pickN(globalRand{}, group, n, 0)
+}
+
+// PickNWith is like PickN, with flags letting draining or unhealthy members count toward n.
+// It returns ErrPickCount if n is negative, ErrNoMember if the group has fewer than n members, ErrNotEnoughEligible if it has
+// enough members but fewer than n of them are eligible, and ErrServiceDegraded if the group has
+// too few healthy members, see SetMinHealthy.
+func (s *Serf) PickNWith(group string, n int, flags PickFlag) ([]*Member, error) {
+	return s.pickN(globalRand{}, group, n, flags)
+}
+
+// candidates returns the members of the group that are not excluded, sorted by ID so that
+// a seeded source picks the same members for the same seed.
+func (s *Serf) candidates(group string, exclude []string) []*Member {
+	excluded := make(map[string]struct{}, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = struct{}{}
+	}
+
+	candidates := make([]*Member, 0)
+	for _, m := range s.groupMembers(group) {
+		if _, ok := excluded[m.Id]; !ok {
+			candidates = append(candidates, m)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Id < candidates[j].Id
+	})
+	return candidates
+}
+
+// pickExcept is PickExcept with the random source r.
+func (s *Serf) pickExcept(r intner, group string, exclude []string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+
+	candidates := s.candidates(group, exclude)
+	if len(candidates) == 0 {
+		return nil, ErrNoMember
+	}
+	return candidates[r.Intn(len(candidates))], nil
+}
+
+// pickWeighted is PickWeighted with the random source r.
+func (s *Serf) pickWeighted(r intner, group string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+
+	candidates := s.candidates(group, nil)
+	total := 0
+	for _, m := range candidates {
+		total += weight(m)
+	}
+	if total == 0 {
+		return nil, ErrNoMember
+	}
+
+	n := r.Intn(total)
+	for _, m := range candidates {
+		if n -= weight(m); n < 0 {
+			return m, nil
+		}
+	}
+	return nil, ErrNoMember
+}
+
+// pickN is PickNWith with the random source r.
+func (s *Serf) pickN(r intner, group string, n int, flags PickFlag) ([]*Member, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrPickCount, n)
+	}
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+
+	candidates := s.candidates(group, nil)
+	if len(candidates) < n {
+		return nil, fmt.Errorf("%w: group:%s has %d of %d members", ErrNoMember, group, len(candidates), n)
+	}
+
+	preferred := make([]*Member, 0, len(candidates))
+	draining := make([]*Member, 0)
+	for _, m := range candidates {
+		if m.Health() == HealthFail && flags&PickIncludeUnhealthy == 0 {
+			continue
+		}
+		if !m.IsDraining() {
+			preferred = append(preferred, m)
+		} else if flags&PickIncludeDraining != 0 {
+			draining = append(draining, m)
+		}
+	}
+	if len(preferred)+len(draining) < n {
+		return nil, fmt.Errorf("%w: group:%s has %d eligible of %d members, want %d",
+			ErrNotEnoughEligible, group, len(preferred)+len(draining), len(candidates), n)
+	}
+
+	picked := shuffleN(r, preferred, n)
+	if len(picked) < n {
+		picked = append(picked, shuffleN(r, draining, n-len(picked))...)
+	}
+	return picked, nil
+}
+
+// shuffleN returns up to n random members of the members, reordering them in place by a partial
+// Fisher-Yates shuffle.
+func shuffleN(r intner, members []*Member, n int) []*Member {
+	if n > len(members) {
+		n = len(members)
+	}
+	for i := 0; i < n; i++ {
+		j := i + r.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:n]
+}
+
+// weight returns the replicas of the member, or 0 if they are not a positive number.
+func weight(m *Member) int {
+	w, err := strconv.Atoi(m.Replicas)
+	if err != nil || w <= 0 {
+		return 0
+	}
+	return w
+}
+
+// Picker is like the random selection helpers of Serf, PickExcept, PickWeighted and PickN, but
+// draws from its own random source, so that tests and distribution debugging can reproduce the
+// picks by seeding it. It is safe for concurrent use.
+type Picker struct {
+	serf *Serf
+	rand *lockedRand
+}
+
+// lockedRand is an intner serializing the draws from a random source.
+type lockedRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+// NewPicker creates a Picker over the members of s drawing from src, such as rand.NewSource(1).
+func NewPicker(s *Serf, src rand.Source) *Picker {
+	return &Picker{
+		serf: s,
+		rand: &lockedRand{r: rand.New(src)},
+	}
+}
+
+// Intn implements intner.
+func (l *lockedRand) Intn(n int) int {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Intn(n)
+}
+
+// PickExcept is like Serf.PickExcept, drawing from the random source of the Picker.
+func (p *Picker) PickExcept(group string, exclude ...string) (*Member, error) {
+	return p.serf.pickExcept(p.rand, group, exclude)
+}
+
+// PickWeighted is like Serf.PickWeighted, drawing from the random source of the Picker.
+func (p *Picker) PickWeighted(group string) (*Member, error) {
+	return p.serf.pickWeighted(p.rand, group)
+}
+
+// PickN is like Serf.PickN, drawing from the random source of the Picker.
+func (p *Picker) PickN(group string, n int) ([]*Member, error) {
+	return p.serf.pickN(p.rand, group, n, 0)
+}
+
+// PickNWith is like Serf.PickNWith, drawing from the random source of the Picker.
+func (p *Picker) PickNWith(group string, n int, flags PickFlag) ([]*Member, error) {
+	return p.serf.pickN(p.rand, group, n, flags)
+}
+
+// SetMinHealthy sets the minimum number of healthy members of the group. Below it, the selection
+// helpers return ErrServiceDegraded instead of picking, so that callers can fail fast and shed
+// load instead of overwhelming the last members of a shrinking group. Members reporting
+// HealthFail and leaving members are not healthy. A minimum of zero or less removes the guard.
+// It can be called at any time.
+func (s *Serf) SetMinHealthy(group string, n int) {
+	if n <= 0 {
+		s.minHealthy.Delete(group)
+		return
+	}
+	s.minHealthy.Store(group, n)
+}
+
+// checkHealthy returns ErrServiceDegraded if the group has fewer healthy members than its minimum.
+func (s *Serf) checkHealthy(group string) error {
+	val, ok := s.minHealthy.Load(group)
+	if !ok {
+		return nil
+	}
+
+	healthy := 0
+	for _, m := range s.groupMembers(group) {
+		if m.Health() != HealthFail {
+			healthy++
+		}
+	}
+	if floor := val.(int); healthy < floor {
+		return fmt.Errorf("%w: group:%s, healthy:%d, min:%d", ErrServiceDegraded, group, healthy, floor)
+	}
+	return nil
+}
+
+// PickCtx is like PickExcept, but waits for a member of the group to become available instead of
+// failing with ErrNoMember. It returns ctx.Err() if no member is available before ctx is done,
+// which bounds the wait by the deadline of the request. ErrServiceDegraded is returned at once.
+func (s *Serf) PickCtx(ctx context.Context, group string, exclude ...string) (*Member, error) {
+	return s.waitPick(ctx, group, func() (*Member, error) {
+		return s.PickExcept(group, exclude...)
+	})
+}
+
+// waitPick calls pick until it picks a member, retrying on every event of the group while pick
+// returns ErrNoMember. It returns ctx.Err() if ctx is done first.
+func (s *Serf) waitPick(ctx context.Context, group string, pick func() (*Member, error)) (*Member, error) {
+	events, cancel := s.SubscribeGroup(group)
+	defer cancel()
+
+	for {
+		m, err := pick()
+		if !errors.Is(err, ErrNoMember) {
+			return m, err
+		}
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SmoothWRR picks the members of a group by smooth weighted round-robin, the algorithm of nginx,
+// weighted by their replicas. Over any short window the picks closely follow the weights,
+// without the bursts of a random weighted pick. It is safe for concurrent use.
+type SmoothWRR struct {
+	sync.Mutex
+	serf    *Serf
+	current map[string]map[string]int // the current weight of every member by ID, by group
+}
+
+// NewSmoothWRR creates a smooth weighted round-robin selector over the members of s.
+func NewSmoothWRR(s *Serf) *SmoothWRR {
+	return &SmoothWRR{
+		serf:    s,
+		current: make(map[string]map[string]int),
+	}
+}
+
+// Next returns the next member of the group. Leaving members and members whose replicas are
+// not a positive number are skipped. It returns ErrNoMember if there is no member to pick, and
+// ErrServiceDegraded if the group has too few healthy members, see SetMinHealthy.
+func (w *SmoothWRR) Next(group string) (*Member, error) {
+	if err := w.serf.checkHealthy(group); err != nil {
+		return nil, err
+	}
+	members := w.serf.groupMembers(group)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id < members[j].Id
+	})
+
+	w.Lock()
+	defer w.Unlock()
+
+	current := w.current[group]
+	if current == nil {
+		current = make(map[string]int)
+		w.current[group] = current
+	}
+
+	var best *Member
+	total := 0
+	seen := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		w := weight(m)
+		if w == 0 {
+			continue
+		}
+		seen[m.Id] = struct{}{}
+		current[m.Id] += w
+		total += w
+		if best == nil || current[m.Id] > current[best.Id] {
+			best = m
+		}
+	}
+
+	// Forget the members that are gone, a member that comes back starts afresh.
+	for id := range current {
+		if _, ok := seen[id]; !ok {
+			delete(current, id)
+		}
+	}
+	if best == nil {
+		return nil, ErrNoMember
+	}
+	current[best.Id] -= total
+	return best, nil
+}
+
+// NextCtx is like Next, but waits for a member of the group to become available instead of
+// failing with ErrNoMember. It returns ctx.Err() if no member is available before ctx is done.
+func (w *SmoothWRR) NextCtx(ctx context.Context, group string) (*Member, error) {
+	return w.serf.waitPick(ctx, group, func() (*Member, error) {
+		return w.Next(group)
+	})
+}
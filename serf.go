@@ -1,6 +1,8 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,10 +11,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/logutils"
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 	"github.com/natefinch/lumberjack"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -24,34 +30,165 @@ const (
 
 	// TagReplicas is the tag key of replicas.
 	TagReplicas = "replicas"
+
+	// TagId is the tag key of the member ID, set only when it differs from the serf node name.
+	TagId = "id"
+
+	// TagHealth is the tag key of the health reported by the member.
+	TagHealth = "health"
+
+	// TagJoinedTs is the tag key of the time the member started, in Unix nanoseconds.
+	TagJoinedTs = "joined_ts"
+
+	// TagClusterId is the reserved tag of the cluster id, see SetClusterId.
+	TagClusterId = "cluster_id"
 )
 
 // Serf represents a discovery instance of hashicorp/serf.
 type Serf struct {
-	events  chan serf.Event // A channel to expose Serf events.
-	member  *Member         // The local member of the current registry server.
-	serf    *serf.Serf      // A single node that is part of a single cluster that gets events about joins/leaves/failures/etc.
-	handler Handler         // An auto-discover event notification interface.
-	members sync.Map        // The members of all services.
+	events   chan serf.Event // A channel to expose Serf events.
+	member   *Member         // The local member of the current registry server.
+	serf     *serf.Serf      // A single node that is part of a single cluster that gets events about joins/leaves/failures/etc.
+	handler  Handler         // An auto-discover event notification interface.
+	members  sync.Map        // The members of all services.
+	queue    *eventQueue     // The internal queue between serf event delivery and the handler.
+	done     chan struct{}   // Closed when the event loop exits.
+	shutdown chan struct{}   // Closed when Stop is called to stop the background goroutines.
+
+	overflows   atomic.Uint64 // The number of events queued above the high water mark.
+	version     atomic.Uint64 // The membership version, incremented on every mutation of the members.
+	stopping    atomic.Bool   // Whether serf is being shut down intentionally.
+	unplanned   atomic.Bool   // Whether serf shut down without being stopped.
+	size        atomic.Int64  // The number of stored members.
+	subscribers subscribers   // The subscribers of membership events.
+	kv          *KV           // The cluster-wide key value store.
+
+	auditor *auditor     // The optional sink of membership transitions.
+	tracer  trace.Tracer // The optional tracer of handler dispatch.
+	metrics Metrics      // The optional sink of metrics.
+	clock   Clock        // The source of time of the time-based features.
+
+	conflictLock   sync.Mutex         // The lock of the recorded node name conflict.
+	conflict       *nameConflict      // The first node name conflict seen by memberlist.
+	localNode      *serf.Member       // The local node as memberlist advertises it, nil until serf is created.
+	conflictPolicy NameConflictPolicy // The policy applied to a node name conflict on Start.
+	onNameConflict NameConflictFunc   // The optional function deciding the conflict policy.
+	mergeFunc      MergeFunc          // The optional function vetoing merges with other clusters.
+	clusterId      string             // The id of the cluster, members of other clusters are rejected.
+
+	protocol           uint8         // The serf protocol version to speak, 0 means the serf default.
+	iface              string        // The network interface to bind and advertise on, empty uses the member addresses.
+	sweepInterval      time.Duration // The interval of the stale member sweep, 0 disables it.
+	statsInterval      time.Duration // The interval of the cluster stats sampling, 0 disables it.
+	checkInterval      time.Duration // The interval of the health check of the local service, 0 disables it.
+	checkTimeout       time.Duration // How long a health check waits for the service to accept a connection.
+	jitter             float64       // The jitter fraction of the periodic background work.
+	leaveGrace         time.Duration // How long left or failed members are kept as leaving, 0 removes them immediately.
+	failedGrace        time.Duration // How long failed members are kept as suspect, 0 handles failures immediately.
+	replayEvents       bool          // Whether joining replays the user events broadcast before the join.
+	disableCoordinates bool          // Whether serf stops gossiping network coordinates.
+	rejoinAfterLeave   bool          // Whether a left node may rejoin the cluster with Rejoin.
+	rejoinInterval     time.Duration // The interval between the join attempts of Rejoin.
+	rejoinAttempts     int           // The maximum number of join attempts of Rejoin.
+	rejoinPending      bool          // Whether ReconcileAdvertise failed to rejoin and retries on its next call.
+	bindAttempts       int           // The maximum number of attempts to create serf while the bind address is in use.
+	bindBackoff        time.Duration // The delay before the first retry of a bind address in use.
+	reconnectInterval  time.Duration // The interval of the reconnect attempts to failed members, 0 means the default.
+	tagsFile           string        // The optional file of tags managed by external tooling.
+	tagsFileInterval   time.Duration // The interval of checking the tags file for changes.
+	tagsFromEnv        bool          // Whether the environment variables in the tag values are resolved on Start.
+	maxMembers         int           // The maximum number of stored members, 0 means unlimited.
+	strictAdvertise    bool          // Whether a loopback advertise address with remote registries fails Start.
+	handlerTimeout     time.Duration // How long a handler call may take, 0 means no limit.
+	keyringFile        string        // The optional file persisting the gossip encryption keys.
+	bootstrap          bool          // Whether the node is intentionally the first node of a new cluster.
+	bootstrapSet       bool          // Whether SetBootstrap was called.
+	trackConvergence   bool          // Whether the gossip convergence latency of joins is recorded.
+	startedAt          time.Time     // The time the local member started.
+	gossipInterval     time.Duration // The interval of gossip, 0 means the serf default.
+	gossipNodes        int           // The number of nodes gossiped to per interval.
+	pushPullInterval   time.Duration // The interval of full state syncs, 0 means the serf default.
+	propagateDelay     time.Duration // How long a graceful leave waits for the leave to propagate.
+	propagateDelaySet  bool          // Whether SetLeavePropagateDelay was called.
+	reclaimTime        time.Duration // How long a dead node must be dead before its name can be reused.
+
+	health   healthReporter // The debouncer of the local health reports.
+	tagsLock sync.Mutex     // Serializes the tag updates of the local member.
+
+	onReplicasChanged ReplicasChangedFunc // The optional function called when a member changes its replicas.
+	onMembersReplaced MembersReplacedFunc // The optional function called with the previous and current members on a change.
+	onAddressChanged  AddressChangedFunc  // The optional function called when a member changes its service address.
+	onHandlerPanic    func(recovered any) // The optional function called when the handler panics.
+	addressResolver   AddressResolver     // The optional function deriving the service address of members.
+	advertiseResolver AdvertiseResolver   // The optional function resolving the advertise address on Start.
+	memberInterceptor MemberInterceptor   // The optional function vetoing or transforming members before they are tracked.
+	onSelfFailed      func()              // The optional function called when the local member is reported failed.
+	onSelfRejoined    func()              // The optional function called when the local member is reported alive again.
+	onLoopExit        func(err error)     // The optional function called when membership is no longer tracked.
+	onMemberOverflow  func(m *Member)     // The optional function called when a member is not stored for the member cap.
+	configure         func(*serf.Config)  // The optional function customizing the serf configuration, see SetSerfConfig.
+	onTagsRejected    TagsRejectedFunc    // The optional function called when the gossiped tags don't match the set ones.
+	onReconnecting    func(id string)     // The optional function called for the failed members serf reconnects to.
+	selfFailed        atomic.Bool         // Whether peers declared the local member failed, since it was gossiped alive.
+
+	failedAt map[string]time.Time // The recently failed members by ID, only accessed by the event loop.
+	seq      uint64               // The sequence number of the last membership transition, only accessed by the event loop.
+	counts   memberCounts         // The member counts per group and service.
+	snapshot membersSnapshot      // The members last passed to the members replaced function.
+	keyring  *memberlist.Keyring  // The gossip encryption keys, nil if gossip is not encrypted.
+
+	minHealthy sync.Map   // The minimum number of healthy members per group, see SetMinHealthy.
+	strategies sync.Map   // The selection strategy per group, see SetStrategy.
+	rr         sync.Map   // The round-robin counter per group.
+	wrr        *SmoothWRR // The smooth weighted round-robin of StrategyWeighted.
 }
 
 // NewSerf creates a new instance of Serf.
 func NewSerf(local *Member) *Serf {
 	s := &Serf{
 		member: local,
+		clock:  realClock{},
+		jitter: DefaultJitter,
 	}
+	s.kv = newKV(s)
+	s.wrr = NewSmoothWRR(s)
 	return s
 }
 
 // LocalMember returns the current registry service.
 func (s *Serf) LocalMember() *Member {
-	node, ok := s.members.Load(s.member.Id)
+	return s.loadMember(s.member.Id)
+}
+
+// loadMember returns the stored member of the ID, or nil if there is none.
+func (s *Serf) loadMember(id string) *Member {
+	node, ok := s.members.Load(id)
 	if !ok {
 		return nil
 	}
 	return node.(*Member)
 }
 
+// storeMember stores a member, increments the membership version and reports the change, see
+// OnMembersReplaced.
+func (s *Serf) storeMember(m *Member) {
+	if _, loaded := s.members.Swap(m.Id, m); !loaded {
+		s.size.Add(1)
+	}
+	s.version.Add(1)
+	s.replaced()
+}
+
+// deleteMember deletes the member of the ID, increments the membership version and reports the
+// change, see OnMembersReplaced.
+func (s *Serf) deleteMember(id string) {
+	if _, loaded := s.members.LoadAndDelete(id); loaded {
+		s.size.Add(-1)
+	}
+	s.version.Add(1)
+	s.replaced()
+}
+
 // Members returns the members of all services.
 func (s *Serf) Members() []*Member {
 	nodes := make([]*Member, 0)
@@ -62,55 +199,241 @@ func (s *Serf) Members() []*Member {
 	return nodes
 }
 
+// MembersByTag returns the members whose tag key equals value, such as the members of a zone,
+// shard or tenant.
+func (s *Serf) MembersByTag(key string, value string) []*Member {
+	members := make([]*Member, 0)
+	s.RangeMembers(func(m *Member) bool {
+		if v, ok := m.GetTag(key); ok && v == value {
+			members = append(members, m)
+		}
+		return true
+	})
+	return members
+}
+
+// FindMembers returns up to limit members for which pred returns true, and stops scanning the
+// members once limit matches are found, which is cheaper than filtering all the members when
+// any few matching members will do. A limit of zero or less returns all the matching members.
+// Like RangeMembers, which members are found first is unspecified.
+func (s *Serf) FindMembers(limit int, pred func(m *Member) bool) []*Member {
+	members := make([]*Member, 0)
+	s.RangeMembers(func(m *Member) bool {
+		if pred(m) {
+			members = append(members, m)
+		}
+		return limit <= 0 || len(members) < limit
+	})
+	return members
+}
+
+// SerfMembers returns serf's own member list, including the failed, leaving and left members
+// with their exact serf status and protocol versions. It is the authoritative gossip view,
+// while Members is the view the registry routes on, so comparing both explains why routing
+// differs from what serf sees. It returns nil if serf is not started.
+func (s *Serf) SerfMembers() []serf.Member {
+	if s.serf == nil {
+		return nil
+	}
+	return s.serf.Members()
+}
+
+// RangeMembers calls f for each member, without allocating a slice, until f returns false.
+// Like sync.Map.Range, it doesn't see a consistent snapshot of the members, a member stored or
+// deleted concurrently may or may not be visited.
+func (s *Serf) RangeMembers(f func(m *Member) bool) {
+	s.members.Range(func(key any, val any) bool {
+		return f(val.(*Member))
+	})
+}
+
 // SetHandler sets the event processing handler when new services are discovered.
 func (s *Serf) SetHandler(h Handler) {
 	s.handler = h
 }
 
-// Stop stops the Serf server.
+// SetAuditWriter sets the writer that receives an append-only audit log of every membership transition.
+// Each join, update, leave, failed and reap event is written as one JSON line. Writes happen on a
+// separate goroutine and never block the event loop. If the writer falls 1024 records behind,
+// new records are dropped rather than queued: each dropped record increments MetricAuditDropped,
+// and a warning is logged when the drops start and once the writer catches up. It must be
+// called before Start.
+func (s *Serf) SetAuditWriter(w io.Writer) {
+	if s.auditor != nil {
+		s.auditor.close()
+		s.auditor = nil
+	}
+	if w != nil {
+		s.auditor = newAuditor(w)
+	}
+}
+
+// SetMetrics sets the sink that receives membership counters and handler dispatch timings.
+// It must be called before Start.
+func (s *Serf) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+// SetProtocolVersion pins the serf protocol version, which is useful to interoperate with older
+// nodes during a rolling upgrade. It returns ErrProtocolVersion if v is outside the range
+// supported by serf. It must be called before Start.
+//
+// The registry is built on serf v0.10.1, which speaks serf protocol versions 2 to 5
+// (default 5), all of which map to memberlist protocol version 2.
+func (s *Serf) SetProtocolVersion(v uint8) error {
+	if v < serf.ProtocolVersionMin || v > serf.ProtocolVersionMax {
+		return ErrProtocolVersion
+	}
+	s.protocol = v
+	return nil
+}
+
+// EventOverflows returns the number of events that were queued while the internal event queue
+// was above its high water mark, which means the handler is not keeping up with serf.
+// Events are never dropped, serf delivery is decoupled from the handler by the queue.
+func (s *Serf) EventOverflows() uint64 {
+	return s.overflows.Load()
+}
+
+// MembershipVersion returns the membership version, which increases on every join, update,
+// leave, failure and removal of a member. A consumer caching a structure derived from the
+// members, such as a routing table, can compare versions to tell whether it must rebuild it,
+// instead of diffing the member lists. The same version means the members are unchanged.
+func (s *Serf) MembershipVersion() uint64 {
+	return s.version.Load()
+}
+
+// Stop stops the Serf server. It is like Close, but only logs the errors of the shutdown.
 func (s *Serf) Stop() {
-	// Shutdown serf
+	if err := s.Close(); err != nil {
+		log.Printf("[WARN] Serf server stopped with err:%s\n", err.Error())
+		return
+	}
+	log.Printf("[DEBUG] Serf server stopped.\n")
+}
+
+// Close stops the Serf server and implements io.Closer. It gracefully leaves the cluster unless
+// the local member has already left, shuts serf down, drains the queued events, stops the
+// background goroutines and the pending health report, and flushes the audit log. Every step is
+// performed even if an earlier one fails, and the errors of the failed steps are joined.
+func (s *Serf) Close() error {
+	var errs []error
 	if s.serf != nil {
-		s.serf.Leave()
-		s.serf.Shutdown()
-		// Wait until serf has finished shutting down
-		<-s.serf.ShutdownCh()
+		s.stopping.Store(true)
+		if s.serf.State() == serf.SerfAlive {
+			if err := s.serf.Leave(); err != nil {
+				errs = append(errs, fmt.Errorf("serf leave: %w", err))
+			}
+		}
+		if err := s.serf.Shutdown(); err != nil {
+			errs = append(errs, fmt.Errorf("serf shutdown: %w", err))
+		} else {
+			// Wait until serf has finished shutting down
+			<-s.serf.ShutdownCh()
+		}
+	}
+
+	s.stopLoop()
+	s.health.stop()
+	if s.auditor != nil {
+		s.auditor.close()
+		s.auditor = nil
 	}
+	return errors.Join(errs...)
+}
 
-	if s.events != nil {
+// stopLoop stops the background goroutines and waits for the event loop to drain the queued events.
+// It must be called after serf is shut down, so that serf no longer sends events.
+func (s *Serf) stopLoop() {
+	if s.shutdown != nil {
+		close(s.shutdown)
+		s.shutdown = nil
+	}
+	if s.done != nil {
 		close(s.events)
+		<-s.done
+		s.done = nil
 	}
-	log.Printf("[DEBUG] Serf server stopped.\n")
 }
 
 // Start starts the HashiCorp Serf agent with the configuration provided in s.
+// If another node of the cluster already uses the local node name, the name conflict
+// policy is applied, see SetNameConflictPolicy. A malformed bind or advertise address fails
+// with ErrBindAddr or ErrAdvertiseAddr, wrapping the parse error.
 func (s *Serf) Start() error {
+	return s.start(true)
+}
+
+// start starts the serf agent, retry tells whether a name conflict may be resolved by restarting.
+func (s *Serf) start(retry bool) error {
 	// Initialize variables.
 	var err error
 	var host string
 	var port int
 	cfg := serf.DefaultConfig()
-	s.events = make(chan serf.Event)
+	s.events = make(chan serf.Event, 64)
+
+	// Resolve the address of the network interface to bind and advertise on, if it is set.
+	if s.iface != "" {
+		if err = s.bindInterface(); err != nil {
+			log.Printf("[ERROR] Serf resolve interface:%s failed, err:%s\n", s.iface, err.Error())
+			return err
+		}
+	}
+
+	// Resolve the advertise address, such as the public mapping of a node behind NAT, if a resolver is set.
+	if err = s.resolveAdvertise(); err != nil {
+		log.Printf("[ERROR] Serf resolve advertise addr failed, err:%s\n", err.Error())
+		return err
+	}
 
 	// Extract host and port from Advertise address and set them in the configuration.
+	// Memberlist gossips over both UDP and TCP, and advertises this single address for both
+	// transports, so a port map in front of the node must forward both protocols on that port.
 	host, port, err = s.splitHostPort(s.member.Advertise)
 	if err != nil {
 		log.Printf("[ERROR] Serf splitHostPort advertise addr:%s failed.\n", s.member.Advertise)
-		return err
+		return fmt.Errorf("%w: %s: %w", ErrAdvertiseAddr, s.member.Advertise, err)
 	}
 	cfg.MemberlistConfig.AdvertiseAddr = host
 	cfg.MemberlistConfig.AdvertisePort = port
 
 	// Extract host and port from Bind address and set them in the configuration.
+	// Memberlist listens on both UDP and TCP on this address.
 	host, port, err = s.splitHostPort(s.member.Bind)
 	if err != nil {
 		log.Printf("[ERROR] Serf splitHostPort bind addr:%s failed.\n", s.member.Bind)
-		return err
+		return fmt.Errorf("%w: %s: %w", ErrBindAddr, s.member.Bind, err)
 	}
 	cfg.MemberlistConfig.BindAddr = host
 	cfg.MemberlistConfig.BindPort = port
 	cfg.EventCh = s.events
 
+	// Normalize the addresses of the registries to join.
+	registries, err := s.parseRegistries(s.member.Registries)
+	if err != nil {
+		log.Printf("[ERROR] Serf parse registries:%s failed.\n", s.member.Registries)
+		return err
+	}
+
+	// Tell a deliberate seed node from a forgotten seed list.
+	if len(registries) == 0 {
+		if s.bootstrapSet && !s.bootstrap {
+			log.Printf("[ERROR] Serf has no registries to join and is not a bootstrap node.\n")
+			return ErrNoRegistries
+		}
+		if s.bootstrap {
+			log.Printf("[INFO] Serf bootstrapping a new cluster as its first node.\n")
+		} else {
+			log.Printf("[INFO] Serf has no registries to join, starting a new cluster alone.\n")
+		}
+	}
+
+	// Catch a loopback advertise address that remote registries could never reach.
+	if err = s.checkAdvertise(registries); err != nil {
+		return err
+	}
+
 	// Set up the logger for Serf and the memberlist package.
 	filter := &logutils.LevelFilter{
 		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"},
@@ -124,41 +447,256 @@ func (s *Serf) Start() error {
 	}
 
 	cfg.Logger = log.New(os.Stderr, "", log.LstdFlags)
-	cfg.Logger.SetOutput(filter)
+	cfg.Logger.SetOutput(&selfWatcher{serf: s, next: filter})
 	cfg.MemberlistConfig.Logger = cfg.Logger
 
+	// Load the gossip encryption keys, if there is a keyring file.
+	if s.keyringFile != "" {
+		keyring, err := loadKeyring(s.keyringFile)
+		if err != nil {
+			log.Printf("[ERROR] Serf load keyring file:%s failed.\n", s.keyringFile)
+			return err
+		}
+		cfg.KeyringFile = s.keyringFile
+		cfg.MemberlistConfig.Keyring = keyring
+	}
+
+	// Load the tags managed by external tooling, if there is a tags file, and resolve the
+	// environment variables referenced by the tags, the reloads of the tags file do the same.
+	if s.tagsFile != "" || s.tagsFromEnv {
+		tags, err := s.desiredTags()
+		if err != nil {
+			log.Printf("[ERROR] Serf load tags failed, tags file:%s, err:%s\n", s.tagsFile, err.Error())
+			return err
+		}
+		s.member.replaceTags(tags)
+	}
+
 	// Set the node name and tags in the configuration.
-	cfg.NodeName = s.member.Id
-	cfg.Tags = s.member.GetTags()
+	s.startedAt = s.clock.Now()
+	cfg.NodeName = s.nodeName()
+	cfg.Tags = s.localTags()
+	if s.protocol != 0 {
+		cfg.ProtocolVersion = s.protocol
+	}
+	cfg.DisableCoordinates = s.disableCoordinates
+	cfg.RejoinAfterLeave = s.rejoinAfterLeave
+	if s.gossipInterval != 0 {
+		cfg.MemberlistConfig.GossipInterval = s.gossipInterval
+		cfg.MemberlistConfig.GossipNodes = s.gossipNodes
+	}
+	if s.pushPullInterval != 0 {
+		cfg.MemberlistConfig.PushPullInterval = s.pushPullInterval
+	}
+	if s.propagateDelaySet {
+		cfg.LeavePropagateDelay = s.propagateDelay
+	}
+	cfg.MemberlistConfig.DeadNodeReclaimTime = s.reclaimTime
+	if s.reconnectInterval > 0 {
+		cfg.ReconnectInterval = s.reconnectInterval
+	}
+	if s.mergeFunc != nil || s.clusterId != "" {
+		cfg.Merge = &mergeDelegate{serf: s}
+	}
+
+	// Let the caller customize the configuration, then restore the fields the registry owns.
+	if s.configure != nil {
+		s.configure(cfg)
+		cfg.EventCh = s.events
+		cfg.NodeName = s.nodeName()
+		cfg.Tags = s.localTags()
+	}
+
+	// Record the node name conflicts from the first alive message on, and forget the ones of a
+	// previous run. The alive delegate of the caller, if any, still vets the messages first.
+	cfg.MemberlistConfig.Alive = &aliveDelegate{serf: s, next: cfg.MemberlistConfig.Alive}
+	s.takeConflict()
+	s.setLocalNode(nil)
+	s.selfFailed.Store(false)
+
+	// The queue exists before serf is created, since the memberlist goroutines may queue events.
+	s.queue = newEventQueue()
 
 	// Create the Serf agent with the configuration.
-	s.serf, err = serf.Create(cfg)
+	s.serf, err = s.createSerf(cfg)
 	if err != nil {
 		return err
 	}
+	local := s.serf.LocalMember()
+	s.setLocalNode(&local)
+
+	// Keep the keyring memberlist uses, which also holds the keys set with SetSerfConfig, such as
+	// a SecretKey memberlist builds its keyring from on create.
+	s.keyring = cfg.MemberlistConfig.Keyring
 
 	// Store the member in the members map and start the loop.
-	s.members.Store(s.member.Id, s.member)
+	s.storeMember(s.member)
+	s.done = make(chan struct{})
+	s.shutdown = make(chan struct{})
+	s.stopping.Store(false)
+	s.unplanned.Store(false)
+	go s.drain(s.events, s.queue)
 	go s.loop()
+	go s.watchShutdown(s.serf.ShutdownCh(), s.shutdown)
+	if s.sweepInterval > 0 {
+		go s.runSweeper(s.shutdown)
+	}
+	if s.statsInterval > 0 && s.metrics != nil {
+		go s.runStatsSampler(s.shutdown)
+	}
+	if s.tagsFile != "" {
+		go s.runTagsFileWatcher(s.shutdown)
+	}
+	if s.checkInterval > 0 {
+		go s.runHealthCheck(s.shutdown)
+	}
+	if s.onReconnecting != nil {
+		go s.runReconnectWatcher(s.shutdown)
+	}
 
 	// Print the bind and advertise addresses to the log.
 	log.Printf("[INFO] Serf discovery started, current service bind:%s, advertise addr:%s\n", s.member.Bind, s.member.Advertise)
 
 	// Join any registries that were specified in the member's configuration.
-	if len(s.member.Registries) > 0 {
-		members := strings.Split(s.member.Registries, ",")
-		s.Join(members)
+	if len(registries) > 0 {
+		if err := s.Join(registries); err != nil {
+			log.Printf("[WARN] Serf join registries:%s failed, err:%s\n", s.member.Registries, err.Error())
+		}
+	}
+
+	if c := s.takeConflict(); c != nil {
+		return s.resolveConflict(c, retry)
 	}
 	return nil
 }
 
+// nodeName returns the serf node name of the local member, which defaults to its ID.
+func (s *Serf) nodeName() string {
+	if s.member.Name != "" {
+		return s.member.Name
+	}
+	return s.member.Id
+}
+
+// localTags returns the tags gossiped for the local member.
+// The member ID is carried in a tag when it differs from the serf node name.
+func (s *Serf) localTags() map[string]string {
+	return s.gossipTags(s.member.GetTags())
+}
+
+// gossipTags adds the tags that serf manages for the local member to the given tags, which may be nil.
+func (s *Serf) gossipTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	if s.nodeName() != s.member.Id {
+		tags[TagId] = s.member.Id
+	}
+	if s.clusterId != "" {
+		tags[TagClusterId] = s.clusterId
+	}
+	if s.trackConvergence {
+		tags[TagJoinedTs] = strconv.FormatInt(s.startedAt.UnixNano(), 10)
+	}
+	return tags
+}
+
+// SetReplayEvents sets whether joining a cluster replays the user events that were broadcast
+// before the join, which late-joining nodes need to catch up. Replaying can deliver the same
+// user event more than once, so consumers of user events must be idempotent.
+// It defaults to false, and must be called before Start.
+func (s *Serf) SetReplayEvents(replay bool) {
+	s.replayEvents = replay
+}
+
 // Join joins the Serf agent to an existing Serf cluster with the specified members.
 func (s *Serf) Join(members []string) error {
-	_, err := s.serf.Join(members, true)
+	_, err := s.serf.Join(members, !s.replayEvents)
 	return err
 }
 
+// parseRegistries splits the comma separated addresses of the registries, trims them, drops empty
+// and duplicate entries while keeping the first-seen order, and checks that every entry is a host:port.
+// The returned error lists all the malformed entries.
+func (s *Serf) parseRegistries(registries string) ([]string, error) {
+	addrs := make([]string, 0)
+	malformed := make([]string, 0)
+	seen := make(map[string]struct{})
+
+	for _, addr := range strings.Split(registries, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+
+		if _, _, err := s.splitHostPort(addr); err != nil {
+			malformed = append(malformed, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	if len(malformed) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrParseRegistries, strings.Join(malformed, ","))
+	}
+	return addrs, nil
+}
+
+// SetBootstrap sets whether the node is intentionally the first node of a new cluster, which
+// starts alone without registries to join. If it is set to false, Start fails with
+// ErrNoRegistries when there are no registries, which catches a forgotten seed list.
+// If it is not called, a node without registries starts alone and logs that it does.
+// It must be called before Start.
+func (s *Serf) SetBootstrap(bootstrap bool) {
+	s.bootstrap = bootstrap
+	s.bootstrapSet = true
+}
+
+// SetStrictAdvertise sets whether Start fails with ErrLoopbackAdvertise, instead of logging a
+// warning, when the advertise address is loopback while a registry is on another host.
+// It must be called before Start.
+func (s *Serf) SetStrictAdvertise(strict bool) {
+	s.strictAdvertise = strict
+}
+
+// checkAdvertise warns, or fails if the advertise check is strict, when the advertise address is
+// loopback but a registry is not, which lets the node start while remote nodes can never reach it.
+func (s *Serf) checkAdvertise(registries []string) error {
+	host, _, err := s.splitHostPort(s.member.Advertise)
+	if err != nil || !isLoopback(host) {
+		return nil
+	}
+
+	for _, registry := range registries {
+		h, _, err := s.splitHostPort(registry)
+		if err != nil || isLoopback(h) {
+			continue
+		}
+		if s.strictAdvertise {
+			return fmt.Errorf("%w: advertise:%s, registry:%s", ErrLoopbackAdvertise, s.member.Advertise, registry)
+		}
+		log.Printf("[WARN] Serf advertise addr:%s is loopback but registry:%s is not, remote nodes won't be able to reach this node\n", s.member.Advertise, registry)
+		return nil
+	}
+	return nil
+}
+
+// isLoopback returns true if the host is a loopback IP or localhost.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // splitHostPort splits an address of the form "host:port" into separate host and port strings.
+// It doesn't tell which address it parsed, callers that parse the bind or advertise address wrap
+// its error with ErrBindAddr or ErrAdvertiseAddr.
 func (s *Serf) splitHostPort(addr string) (string, int, error) {
 	h, p, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -172,62 +710,310 @@ func (s *Serf) splitHostPort(addr string) (string, int, error) {
 	return h, port, nil
 }
 
-// loop reads exposing Serf events and passes events to the handler
+// memberId returns the member ID of a serf member, carried in the id tag when it differs from the node name.
+func memberId(member serf.Member) string {
+	if tagId, ok := member.Tags[TagId]; ok && tagId != "" {
+		return tagId
+	}
+	return member.Name
+}
+
+// newMember creates a Member object from a serf member.
+func (s *Serf) newMember(member serf.Member) *Member {
+	id := memberId(member)
+	addr := fmt.Sprintf("%s:%d", member.Addr, member.Port)
+	latest := NewSimpleMember(id, addr, addr)
+	latest.Name = member.Name
+	latest.SetTags(member.Tags)
+	if s.addressResolver != nil {
+		if addr := s.addressResolver(&member); addr != "" {
+			latest.Service.Addr = addr
+		}
+	}
+	return latest
+}
+
+// AddressResolver derives the address clients connect to for the service of a serf member.
+type AddressResolver func(member *serf.Member) string
+
+// SetAddressResolver sets the function deriving the service address of the discovered members,
+// such as from a port tag, instead of the addr tag. An empty result keeps the addr tag.
+// It defaults to nil, which uses the addr tag, and must be called before Start.
+func (s *Serf) SetAddressResolver(fn AddressResolver) {
+	s.addressResolver = fn
+}
+
+// observe reports a membership transition to the metrics sink and the audit log if they are set,
+// and returns the sequence number assigned to the transition. Reaps are not delivered to
+// subscribers, so they don't take a sequence number.
+func (s *Serf) observe(t serf.EventType, m *Member) uint64 {
+	var seq uint64
+	if t != serf.EventMemberReap {
+		s.seq++
+		seq = s.seq
+	}
+	recovered := s.trackRecovery(t, m)
+	if s.metrics != nil {
+		switch t {
+		case serf.EventMemberJoin:
+			s.metrics.IncrCounter(MetricMemberJoin, 1)
+			if recovered {
+				s.metrics.IncrCounter(MetricMemberRecovered, 1)
+			}
+		case serf.EventMemberUpdate:
+			if recovered {
+				s.metrics.IncrCounter(MetricMemberRecovered, 1)
+			}
+		case serf.EventMemberLeave:
+			s.metrics.IncrCounter(MetricMemberLeft, 1)
+		case serf.EventMemberFailed:
+			s.metrics.IncrCounter(MetricMemberFailed, 1)
+		}
+	}
+
+	if s.auditor == nil {
+		return seq
+	}
+	queued := s.auditor.record(&AuditRecord{
+		Time:      s.clock.Now(),
+		Event:     t.String(),
+		Id:        m.Id,
+		Addr:      m.Advertise,
+		Tags:      m.GetTags(),
+		Seq:       seq,
+		Recovered: recovered,
+	})
+	if !queued && s.metrics != nil {
+		s.metrics.IncrCounter(MetricAuditDropped, 1)
+	}
+	return seq
+}
+
+// dispatch passes an event of a member to the handler method matching the event type.
+// A panic of the handler is recovered and returned as ErrHandlerPanic, so one buggy
+// handler doesn't stop the event loop. If a handler timeout is set, the call is abandoned
+// and ErrHandlerTimeout is returned once it has passed, see reconcileLate for a late return.
+func (s *Serf) dispatch(t serf.EventType, m *Member) (err error) {
+	if s.handler == nil {
+		return nil
+	}
+
+	var method string
+	var call func(context.Context, *Member) error
+	switch t {
+	case serf.EventMemberJoin:
+		method, call = "OnMemberJoin", s.handler.OnMemberJoin
+	case serf.EventMemberUpdate:
+		method, call = "OnMemberUpdate", s.handler.OnMemberUpdate
+	case serf.EventMemberLeave, serf.EventMemberFailed:
+		method, call = "OnMemberLeave", s.handler.OnMemberLeave
+	default:
+		return nil
+	}
+
+	ctx, span := s.startSpan(context.Background(), method, t, m)
+	var start time.Time
+	if s.metrics != nil {
+		start = time.Now()
+	}
+	defer func() {
+		if s.metrics != nil {
+			d := time.Since(start)
+			s.metrics.ObserveDuration(MetricHandlerDispatch, d)
+			if hm, ok := s.metrics.(HandlerMetrics); ok {
+				hm.ObserveHandlerDuration(method, d)
+			}
+		}
+		endSpan(span, err)
+	}()
+
+	if s.handlerTimeout <= 0 {
+		return s.invoke(ctx, method, call, t, m)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.handlerTimeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- s.invoke(ctx, method, call, t, m)
+	}()
+
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		log.Printf("[ERROR] serf handler %s timed out after %s, id:%s, event:%s\n", method, s.handlerTimeout, m.Id, t)
+		if t == serf.EventMemberJoin || t == serf.EventMemberUpdate {
+			go s.reconcileLate(s.queue, result, m)
+		}
+		return fmt.Errorf("%w: %s after %s", ErrHandlerTimeout, method, s.handlerTimeout)
+	}
+}
+
+// reconcileLate waits for an abandoned join or update call, whose member was vetoed, and then
+// reconciles the handler with the stored member on the event loop. The late call may still have
+// applied the vetoed member, such as the Registry inserting it on the hash ring.
+func (s *Serf) reconcileLate(queue *eventQueue, result <-chan error, m *Member) {
+	<-result
+	queue.push(internalEvent(func() {
+		stored := s.loadMember(m.Id)
+		if stored == m {
+			return
+		}
+
+		var err error
+		if stored == nil || stored.IsLeaving() {
+			log.Printf("[WARN] serf handler returned after timing out, retracting the vetoed member, id:%s\n", m.Id)
+			err = s.dispatch(serf.EventMemberLeave, m)
+		} else {
+			log.Printf("[WARN] serf handler returned after timing out, restoring the stored member, id:%s\n", m.Id)
+			err = s.dispatch(serf.EventMemberUpdate, stored)
+		}
+		if err != nil {
+			log.Printf("[ERROR] serf reconcile timed out member err:%s\n", err.Error())
+		}
+	}))
+}
+
+// invoke calls a handler method, recovering a panic of the handler as ErrHandlerPanic.
+func (s *Serf) invoke(ctx context.Context, method string, call func(context.Context, *Member) error, t serf.EventType, m *Member) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERROR] serf handler %s panicked, id:%s, event:%s, recovered:%v\n", method, m.Id, t, r)
+			if s.onHandlerPanic != nil {
+				s.onHandlerPanic(r)
+			}
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return call(ctx, m)
+}
+
+// SetHandlerTimeout sets how long a handler call may take. The context passed to the handler
+// is cancelled once the timeout has passed, and the event loop moves on without waiting for
+// the call to return. A timed out join or update is vetoed, the member is not stored. Handlers
+// should check the context before changing their state, since a call returning late is followed
+// by an OnMemberLeave of the vetoed member, or an OnMemberUpdate of the stored one. A timeout
+// of zero, the default, lets handler calls take as long as they need. It must be called before Start.
+func (s *Serf) SetHandlerTimeout(d time.Duration) {
+	s.handlerTimeout = d
+}
+
+// drain moves the serf events into the internal queue, so serf never waits on the handler.
+// It is given the channel and the queue of its run, since a restart replaces the fields.
+func (s *Serf) drain(events <-chan serf.Event, queue *eventQueue) {
+	for e := range events {
+		if n := queue.push(e); n > eventQueueHighWater {
+			s.overflows.Add(1)
+			if s.metrics != nil {
+				s.metrics.IncrCounter(MetricEventOverflow, 1)
+			}
+			if n == eventQueueHighWater+1 {
+				log.Printf("[WARN] serf event queue is above %d events, the handler is not keeping up\n", eventQueueHighWater)
+			}
+		}
+	}
+	queue.close()
+}
+
+// loop reads the queued Serf events and passes events to the handler
 func (s *Serf) loop() {
-	for e := range s.events {
+	defer close(s.done)
+	defer s.loopExited()
+	for {
+		e, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		if fn, ok := e.(internalEvent); ok {
+			fn()
+			continue
+		}
+
 		switch e.EventType() {
 		// handle member join event
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
-				addr := fmt.Sprintf("%s:%d", member.Addr, member.Port)
-				latest := NewSimpleMember(member.Name, addr, addr)
-				latest.SetTags(member.Tags)
-
-				// call handler's OnMemberJoin method and store member
-				if s.handler != nil {
-					if err := s.handler.OnMemberJoin(latest); err == nil {
-						s.members.Store(latest.Id, latest)
+				latest := s.intercept(s.newMember(member))
+				if latest == nil || s.overflowed(latest) {
+					continue
+				}
+				// A suspect member rejoining within the failed grace window never left the
+				// handler and the subscribers, so they see an update, and it is observed as
+				// a recovery rather than a join.
+				t, prev := e.EventType(), s.loadMember(latest.Id)
+				if prev != nil && prev.IsSuspect() {
+					log.Printf("[INFO] suspect member rejoined within the failed grace, id:%s\n", latest.Id)
+					t = serf.EventMemberUpdate
+				}
+				seq := s.observe(t, latest)
+				s.observeConvergence(latest)
+
+				// call handler's OnMemberJoin method and store member, unless the handler timed out
+				if err := s.dispatch(t, latest); err != nil {
+					log.Printf("[ERROR] serf handle member join err:%s\n", err.Error())
+					if errors.Is(err, ErrHandlerTimeout) {
 						continue
-					} else {
-						log.Printf("[ERROR] serf handle member join err:%s\n", err.Error())
 					}
 				}
-				s.members.Store(latest.Id, latest)
+				s.storeMember(latest)
+				s.recount(latest.Id, latest)
+				if t == serf.EventMemberUpdate {
+					s.subscribers.publish(MemberEvent{Type: EventUpdate, Member: latest, Seq: seq}, prev)
+				} else {
+					s.subscribers.publish(MemberEvent{Type: EventJoin, Member: latest, Seq: seq}, nil)
+				}
 			}
 
 		// handle member update event
 		case serf.EventMemberUpdate:
 			for _, member := range e.(serf.MemberEvent).Members {
-				addr := fmt.Sprintf("%s:%d", member.Addr, member.Port)
-				latest := NewSimpleMember(member.Name, addr, addr)
-				latest.SetTags(member.Tags)
-
-				// call handler's OnMemberUpdate method and store member
-				if s.handler != nil {
-					if err := s.handler.OnMemberUpdate(latest); err == nil {
-						s.members.Store(latest.Id, latest)
+				latest := s.intercept(s.newMember(member))
+				if latest == nil || s.overflowed(latest) {
+					continue
+				}
+				seq := s.observe(e.EventType(), latest)
+
+				// call handler's OnMemberUpdate method and store member, unless the handler timed out
+				if err := s.dispatch(e.EventType(), latest); err != nil {
+					log.Printf("[ERROR] serf handle member update err:%s\n", err.Error())
+					if errors.Is(err, ErrHandlerTimeout) {
 						continue
-					} else {
-						log.Printf("[ERROR] serf handle member update err:%s\n", err.Error())
 					}
 				}
-				s.members.Store(latest.Id, latest)
+				prev := s.loadMember(latest.Id)
+				s.storeMember(latest)
+				s.recount(latest.Id, latest)
+				s.checkReplicas(prev, latest)
+				s.checkAddress(prev, latest)
+				s.subscribers.publish(MemberEvent{Type: EventUpdate, Member: latest, Seq: seq}, prev)
 			}
 
-		// handle member leave or failed event
+		// handle member leave or failed event, a failed member may be kept as suspect first
 		case serf.EventMemberLeave, serf.EventMemberFailed:
 			for _, member := range e.(serf.MemberEvent).Members {
-				addr := fmt.Sprintf("%s:%d", member.Addr, member.Port)
-				latest := NewSimpleMember(member.Name, addr, addr)
-				latest.SetTags(member.Tags)
-
-				// delete member and call handler's OnMemberLeave method if it exists
-				s.members.Delete(latest.Id)
-				if s.handler != nil {
-					if err := s.handler.OnMemberLeave(latest); err != nil {
-						log.Printf("[ERROR] serf handle member leave err:%s\n", err.Error())
-					}
+				latest := s.newMember(member)
+				if m := s.intercept(latest); m != nil {
+					latest = m
+				} else if s.loadMember(latest.Id) == nil {
+					continue
+				}
+				if e.EventType() == serf.EventMemberFailed && s.suspect(latest) {
+					continue
 				}
+				s.leave(e.EventType(), latest)
+			}
+
+		// handle member reap event, the member has already been deleted when it left or failed
+		case serf.EventMemberReap:
+			for _, member := range e.(serf.MemberEvent).Members {
+				s.observe(e.EventType(), s.newMember(member))
+			}
+
+		// handle user event, the writes of the key value store
+		case serf.EventUser:
+			if ue := e.(serf.UserEvent); ue.Name == kvEventName {
+				s.kv.apply(ue)
 			}
 		}
 	}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TagShards is the optional tag key of the shards a member owns, as a comma separated list
+// of shard numbers and inclusive ranges, such as "0-3,7,9-12".
+const TagShards = "shards"
+
+// shardRange is an inclusive range of shard numbers.
+type shardRange struct {
+	from int
+	to   int
+}
+
+// parseShards parses the value of the shards tag, it returns ErrShardTag if it is malformed.
+func parseShards(value string) ([]shardRange, error) {
+	ranges := make([]shardRange, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrShardTag, value)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(to)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("%w: %q", ErrShardTag, value)
+			}
+		}
+		ranges = append(ranges, shardRange{from: first, to: last})
+	}
+	return ranges, nil
+}
+
+// owns returns whether the ranges contain the shard.
+func owns(ranges []shardRange, shard int) bool {
+	for _, r := range ranges {
+		if shard >= r.from && shard <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// shardOwners returns the members of the group that announce shards, sorted by ID, with their
+// parsed shards. A member whose shards tag is malformed is logged and skipped.
+func (s *Serf) shardOwners(group string) ([]*Member, [][]shardRange, error) {
+	members := s.groupMembers(group)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id < members[j].Id
+	})
+
+	owners := make([]*Member, 0, len(members))
+	shards := make([][]shardRange, 0, len(members))
+	var malformed error
+	for _, m := range members {
+		value, ok := m.GetTag(TagShards)
+		if !ok {
+			continue
+		}
+		ranges, err := parseShards(value)
+		if err != nil {
+			log.Printf("[WARN] member shards tag is malformed, id:%s, err:%s\n", m.Id, err.Error())
+			if malformed == nil {
+				malformed = fmt.Errorf("%w, id:%s", err, m.Id)
+			}
+			continue
+		}
+		owners = append(owners, m)
+		shards = append(shards, ranges)
+	}
+	return owners, shards, malformed
+}
+
+// MembersForShard returns the members of the group whose shards tag includes the shard, sorted
+// by ID. This supports explicit shard ownership announced by the members, instead of hashing.
+// Members whose shards tag is malformed are skipped, see CheckShards.
+func (s *Serf) MembersForShard(group string, shard int) []*Member {
+	owners, shards, _ := s.shardOwners(group)
+	members := make([]*Member, 0)
+	for i, m := range owners {
+		if owns(shards[i], shard) {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+// CheckShards verifies that the members of the group cover the shards 0 to total-1, each owned
+// by exactly one member. It returns ErrShardTag if a shards tag is malformed, and
+// ErrShardCoverage listing the missing, overlapping and out of range shards otherwise. A total
+// that is not positive can't be covered, it returns ErrShardCoverage too.
+func (s *Serf) CheckShards(group string, total int) error {
+	if total <= 0 {
+		return fmt.Errorf("%w: total:%d is not positive", ErrShardCoverage, total)
+	}
+	owners, shards, err := s.shardOwners(group)
+	if err != nil {
+		return err
+	}
+
+	count := make([]int, total)
+	outside := make([]string, 0)
+	for i, m := range owners {
+		for _, r := range shards[i] {
+			for shard := r.from; shard <= r.to; shard++ {
+				if shard >= total {
+					outside = append(outside, fmt.Sprintf("%d-%d@%s", shard, r.to, m.Id))
+					break
+				}
+				count[shard]++
+			}
+		}
+	}
+
+	missing := make([]string, 0)
+	overlapping := make([]string, 0)
+	for shard, n := range count {
+		if n == 0 {
+			missing = append(missing, strconv.Itoa(shard))
+		} else if n > 1 {
+			overlapping = append(overlapping, strconv.Itoa(shard))
+		}
+	}
+	if len(missing) == 0 && len(overlapping) == 0 && len(outside) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: missing:[%s], overlapping:[%s], out of range:[%s]", ErrShardCoverage,
+		strings.Join(missing, ","), strings.Join(overlapping, ","), strings.Join(outside, ","))
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"strconv"
+	"time"
+)
+
+// ClusterStats is the typed form of the stats serf reports as strings.
+type ClusterStats struct {
+	Members          int    // the number of members known to serf, including failed and left ones
+	Failed           int    // the number of failed members
+	Left             int    // the number of left members
+	HealthScore      int    // the local health score, higher means the node struggles to keep up
+	MemberTime       uint64 // the Lamport time of membership changes
+	EventTime        uint64 // the Lamport time of user events
+	QueryTime        uint64 // the Lamport time of queries
+	IntentQueue      int    // the number of queued membership intents
+	EventQueue       int    // the number of queued user events
+	QueryQueue       int    // the number of queued queries
+	Encrypted        bool   // whether gossip is encrypted
+	CoordinateResets int    // the number of coordinate resets, 0 when coordinates are disabled
+}
+
+// Stats returns the raw stats reported by serf, or nil if serf is not started.
+func (s *Serf) Stats() map[string]string {
+	if s.serf == nil {
+		return nil
+	}
+	return s.serf.Stats()
+}
+
+// ClusterStats returns the serf stats parsed into typed fields.
+func (s *Serf) ClusterStats() (*ClusterStats, error) {
+	if s.serf == nil {
+		return nil, ErrNotStarted
+	}
+	return parseClusterStats(s.serf.Stats()), nil
+}
+
+// HealthScore returns the local health score of memberlist, 0 when the node keeps up with gossip
+// and higher when it struggles to, such as when it misses probes because it is overloaded.
+// A node can feed it into its readiness probe, or advertise it as a tag so that it receives
+// less traffic while degraded. It returns 0 if serf is not started.
+func (s *Serf) HealthScore() int {
+	if s.serf == nil {
+		return 0
+	}
+	return s.serf.Memberlist().GetHealthScore()
+}
+
+// parseClusterStats parses the raw serf stats, missing or malformed values are left zero.
+func parseClusterStats(raw map[string]string) *ClusterStats {
+	atoi := func(key string) int {
+		v, _ := strconv.Atoi(raw[key])
+		return v
+	}
+	atou := func(key string) uint64 {
+		v, _ := strconv.ParseUint(raw[key], 10, 64)
+		return v
+	}
+	encrypted, _ := strconv.ParseBool(raw["encrypted"])
+
+	return &ClusterStats{
+		Members:          atoi("members"),
+		Failed:           atoi("failed"),
+		Left:             atoi("left"),
+		HealthScore:      atoi("health_score"),
+		MemberTime:       atou("member_time"),
+		EventTime:        atou("event_time"),
+		QueryTime:        atou("query_time"),
+		IntentQueue:      atoi("intent_queue"),
+		EventQueue:       atoi("event_queue"),
+		QueryQueue:       atoi("query_queue"),
+		Encrypted:        encrypted,
+		CoordinateResets: atoi("coordinate_resets"),
+	}
+}
+
+// SetStatsInterval enables sampling the cluster stats on the interval and reporting them as gauges
+// to the metrics sink. An interval of zero, the default, disables the sampling.
+// It must be called before Start.
+func (s *Serf) SetStatsInterval(d time.Duration) {
+	s.statsInterval = d
+}
+
+// runStatsSampler reports the cluster stats on every stats interval until shutdown is closed.
+func (s *Serf) runStatsSampler(shutdown <-chan struct{}) {
+	ticker := s.newTicker(s.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			stats := parseClusterStats(s.serf.Stats())
+			s.metrics.SetGauge(MetricClusterMembers, float64(stats.Members))
+			s.metrics.SetGauge(MetricClusterFailed, float64(stats.Failed))
+			s.metrics.SetGauge(MetricClusterLeft, float64(stats.Left))
+			s.metrics.SetGauge(MetricClusterHealthScore, float64(stats.HealthScore))
+			s.metrics.SetGauge(MetricClusterIntentQueue, float64(stats.IntentQueue))
+			s.metrics.SetGauge(MetricClusterEventQueue, float64(stats.EventQueue))
+			s.metrics.SetGauge(MetricClusterQueryQueue, float64(stats.QueryQueue))
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacketSize is the largest UDP payload sent to StatsD, it fits in a typical ethernet MTU.
+const statsdMaxPacketSize = 1432
+
+// StatsD is a Metrics implementation that pushes metrics to a StatsD server over UDP.
+// Metrics are batched and flushed on an interval, or earlier when a batch fills a packet.
+type StatsD struct {
+	sync.Mutex
+	prefix string        // the prefix prepended to every metric name
+	conn   net.Conn      // the UDP connection to the StatsD server
+	buf    bytes.Buffer  // the pending batch of metric lines
+	stop   chan struct{} // closed to stop the flushing goroutine
+	done   chan struct{} // closed when the flushing goroutine exits
+	once   sync.Once     // closes the emitter on the first Close
+	err    error         // the result of the first Close
+}
+
+// NewStatsD creates a StatsD emitter pushing to addr, such as "127.0.0.1:8125".
+// prefix is prepended to every metric name, and interval is how often pending metrics are flushed,
+// jittered by DefaultJitter so that a fleet of emitters doesn't flush in lockstep. It returns
+// ErrFlushInterval if interval is not positive.
+func NewStatsD(addr string, prefix string, interval time.Duration) (*StatsD, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrFlushInterval, interval)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsD{
+		prefix: prefix,
+		conn:   conn,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+// IncrCounter increments the counter of the given name by delta.
+func (s *StatsD) IncrCounter(name string, delta int64) {
+	s.write(name, strconv.FormatInt(delta, 10), "c")
+}
+
+// SetGauge sets the gauge of the given name to value.
+func (s *StatsD) SetGauge(name string, value float64) {
+	s.write(name, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+// ObserveDuration records a timing sample of the given name in milliseconds.
+func (s *StatsD) ObserveDuration(name string, d time.Duration) {
+	s.write(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms")
+}
+
+// SetGroupCount sets the group_members.<group> gauge to the number of members of the group.
+func (s *StatsD) SetGroupCount(group string, n int) {
+	s.write(MetricGroupMembers+"."+group, strconv.Itoa(n), "g")
+}
+
+// SetServiceCount sets the service_members.<service> gauge to the number of members of the service.
+func (s *StatsD) SetServiceCount(service string, n int) {
+	s.write(MetricServiceMembers+"."+service, strconv.Itoa(n), "g")
+}
+
+// ObserveHandlerDuration records a handler_duration.<method> timing sample in milliseconds,
+// which statsd servers aggregate into a histogram.
+func (s *StatsD) ObserveHandlerDuration(method string, d time.Duration) {
+	s.ObserveDuration(MetricHandlerDuration+"."+method, d)
+}
+
+// Close flushes the pending metrics and closes the connection. Closing it again returns the
+// result of the first Close.
+func (s *StatsD) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.err = s.conn.Close()
+	})
+	return s.err
+}
+
+// write appends a metric line to the batch, flushing first if the line does not fit in the packet.
+func (s *StatsD) write(name string, value string, kind string) {
+	line := fmt.Sprintf("%s%s:%s|%s\n", s.prefix, name, value, kind)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.buf.Len()+len(line) > statsdMaxPacketSize {
+		s.flush()
+	}
+	s.buf.WriteString(line)
+}
+
+// flush sends the pending batch, the caller must hold the lock.
+func (s *StatsD) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		log.Printf("[ERROR] statsd flush metrics err:%s\n", err.Error())
+	}
+	s.buf.Reset()
+}
+
+// run flushes the pending batch on every interval until the emitter is closed.
+func (s *StatsD) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := newJitterTicker(realClock{}, interval, DefaultJitter)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.Lock()
+			s.flush()
+			s.Unlock()
+		case <-s.stop:
+			s.Lock()
+			s.flush()
+			s.Unlock()
+			return
+		}
+	}
+}
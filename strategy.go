@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// TagLoad is the optional tag key of the load a member reports, a number where lower means
+// less loaded, such as its in-flight requests. It is used by StrategyP2C.
+const TagLoad = "load"
+
+// Strategy is how Pick selects a member of a group.
+type Strategy int
+
+const (
+	StrategyRandom         Strategy = iota // a random member, the default
+	StrategyRoundRobin                     // the members in turn, in the order of their IDs
+	StrategyWeighted                       // smooth weighted round-robin on the replicas, see SmoothWRR
+	StrategyConsistentHash                 // the member the key hashes to, by rendezvous hashing
+	StrategyP2C                            // the less loaded of two random members, see TagLoad
+	StrategyNearest                        // the member of the lowest estimated round trip time
+)
+
+// String returns the name of the strategy.
+func (st Strategy) String() string {
+	switch st {
+	case StrategyRandom:
+		return "random"
+	case StrategyRoundRobin:
+		return "round_robin"
+	case StrategyWeighted:
+		return "weighted"
+	case StrategyConsistentHash:
+		return "consistent_hash"
+	case StrategyP2C:
+		return "p2c"
+	case StrategyNearest:
+		return "nearest"
+	}
+	return "unknown"
+}
+
+// SetStrategy sets the strategy Pick uses to select a member of the group, so that groups can be
+// balanced differently, such as sticky consistent hashing for caches and P2C for stateless APIs.
+// Groups without a strategy use StrategyRandom. It can be called at any time.
+func (s *Serf) SetStrategy(group string, st Strategy) {
+	s.strategies.Store(group, st)
+}
+
+// Pick selects a member of the group with the strategy of the group, see SetStrategy. The key is
+// only used by StrategyConsistentHash, which picks the same member for the same key as long as
+// the member is present. It returns ErrNoMember if there is no member to pick, and
+// ErrServiceDegraded if the group has too few healthy members, see SetMinHealthy.
+func (s *Serf) Pick(group string, key string) (*Member, error) {
+	st := StrategyRandom
+	if val, ok := s.strategies.Load(group); ok {
+		st = val.(Strategy)
+	}
+
+	switch st {
+	case StrategyRoundRobin:
+		return s.pickRoundRobin(group)
+	case StrategyWeighted:
+		return s.wrr.Next(group)
+	case StrategyConsistentHash:
+		return s.pickHash(group, key)
+	case StrategyP2C:
+		return s.pickP2C(globalRand{}, group)
+	case StrategyNearest:
+		return s.pickNearest(group)
+	}
+	return s.PickExcept(group)
+}
+
+// pickRoundRobin returns the members of the group in turn.
+func (s *Serf) pickRoundRobin(group string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+	candidates := s.candidates(group, nil)
+	if len(candidates) == 0 {
+		return nil, ErrNoMember
+	}
+
+	val, _ := s.rr.LoadOrStore(group, &atomic.Uint64{})
+	next := val.(*atomic.Uint64).Add(1) - 1
+	return candidates[next%uint64(len(candidates))], nil
+}
+
+// pickHash returns the member of the group with the highest hash of the key and its ID, which
+// only moves the keys of a member when it joins or leaves.
+func (s *Serf) pickHash(group string, key string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+
+	var best *Member
+	var bestScore uint64
+	for _, m := range s.candidates(group, nil) {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Id))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoMember
+	}
+	return best, nil
+}
+
+// pickP2C returns the less loaded of two random members of the group.
+func (s *Serf) pickP2C(r intner, group string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+	candidates := s.candidates(group, nil)
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNoMember
+	case 1:
+		return candidates[0], nil
+	}
+
+	i := r.Intn(len(candidates))
+	j := r.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if load(candidates[j]) < load(candidates[i]) {
+		return candidates[j], nil
+	}
+	return candidates[i], nil
+}
+
+// load returns the load reported by the member, 0 if it reports none.
+func load(m *Member) float64 {
+	val, ok := m.GetTag(TagLoad)
+	if !ok {
+		return 0
+	}
+	l, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0
+	}
+	return l
+}
+
+// pickNearest returns the member of the group of the lowest estimated round trip time. Members
+// without a coordinate yet are only picked if no member has one, at random.
+func (s *Serf) pickNearest(group string) (*Member, error) {
+	if err := s.checkHealthy(group); err != nil {
+		return nil, err
+	}
+	candidates := s.candidates(group, nil)
+	if len(candidates) == 0 {
+		return nil, ErrNoMember
+	}
+
+	var best *Member
+	var bestRTT time.Duration
+	for _, m := range candidates {
+		rtt, err := s.DistanceTo(m.Id)
+		if err != nil {
+			continue
+		}
+		if best == nil || rtt < bestRTT {
+			best, bestRTT = m, rtt
+		}
+	}
+	if best == nil {
+		return candidates[globalRand{}.Intn(len(candidates))], nil
+	}
+	return best, nil
+}
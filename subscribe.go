@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber.
+const subscriberBuffer = 128
+
+// EventType is the type of a membership event delivered to subscribers.
+type EventType int
+
+const (
+	EventJoin   EventType = iota // a member joined
+	EventUpdate                  // a member updated its tags
+	EventLeave                   // a member left
+	EventFailed                  // a member failed
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventUpdate:
+		return "update"
+	case EventLeave:
+		return "leave"
+	case EventFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// MemberEvent is a membership change delivered to subscribers.
+type MemberEvent struct {
+	Type   EventType // the type of the change
+	Member *Member   // the member after the change
+
+	// Seq is the sequence number of the membership transition on the local node. It increases by
+	// one on every transition, so a gap reveals missed events, and it matches the Seq of the audit
+	// record of the transition.
+	Seq uint64
+}
+
+// subscriber is a channel receiving membership events, optionally only those of one group.
+type subscriber struct {
+	ch     chan MemberEvent // the channel receiving the events
+	group  string           // the group to receive the events of
+	scoped bool             // whether only the events of the group are received
+}
+
+// subscribers fans membership events out to the subscribed channels.
+type subscribers struct {
+	sync.Mutex
+	next int
+	subs map[int]*subscriber
+}
+
+// subscribe adds a subscriber and returns its channel and a function that removes it.
+func (subs *subscribers) subscribe(group string, scoped bool) (<-chan MemberEvent, func()) {
+	subs.Lock()
+	defer subs.Unlock()
+	if subs.subs == nil {
+		subs.subs = make(map[int]*subscriber)
+	}
+
+	id := subs.next
+	subs.next++
+	sub := &subscriber{
+		ch:     make(chan MemberEvent, subscriberBuffer),
+		group:  group,
+		scoped: scoped,
+	}
+	subs.subs[id] = sub
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			subs.Lock()
+			defer subs.Unlock()
+			delete(subs.subs, id)
+			close(sub.ch)
+		})
+	}
+}
+
+// publish delivers an event to every subscriber without blocking. prev is the stored member
+// before an update, it is used to tell group scoped subscribers that a member moved between groups.
+// The event is dropped for a subscriber whose buffer is full.
+func (subs *subscribers) publish(e MemberEvent, prev *Member) {
+	subs.Lock()
+	defer subs.Unlock()
+	for _, sub := range subs.subs {
+		if !sub.scoped {
+			sub.send(e)
+			continue
+		}
+
+		group := e.Member.Service.Group
+		if e.Type != EventUpdate || prev == nil || prev.Service.Group == group {
+			if group == sub.group {
+				sub.send(e)
+			}
+			continue
+		}
+
+		// The update moved the member between groups.
+		if prev.Service.Group == sub.group {
+			sub.send(MemberEvent{Type: EventLeave, Member: prev, Seq: e.Seq})
+		} else if group == sub.group {
+			sub.send(MemberEvent{Type: EventJoin, Member: e.Member, Seq: e.Seq})
+		}
+	}
+}
+
+// send delivers an event to the subscriber without blocking.
+func (sub *subscriber) send(e MemberEvent) {
+	select {
+	case sub.ch <- e:
+	default:
+		log.Printf("[WARN] subscriber buffer is full, dropped %s event of member:%s\n", e.Type, e.Member.Id)
+	}
+}
+
+// Subscribe returns a channel receiving every membership event after it has been applied to
+// the members, and a function that cancels the subscription and closes the channel.
+// Events are sent in the order the handler observes them, see Handler.
+// A subscriber that does not keep up with the events misses the events that overflow its buffer.
+func (s *Serf) Subscribe() (<-chan MemberEvent, func()) {
+	return s.subscribers.subscribe("", false)
+}
+
+// SubscribeGroup is like Subscribe, but only delivers the events of the members of the group,
+// see Service.Group, rather than of a service, see TagService.
+// When an update moves a member to another group, the subscribers of the old group receive a
+// leave event and the subscribers of the new group receive a join event.
+func (s *Serf) SubscribeGroup(group string) (<-chan MemberEvent, func()) {
+	return s.subscribers.subscribe(group, true)
+}
+
+// WaitForGroup blocks until at least n members of the group are present, or ctx is done.
+// It returns immediately if the group already has n members, and ctx.Err() if ctx is done first.
+func (s *Serf) WaitForGroup(ctx context.Context, group string, n int) error {
+	events, cancel := s.SubscribeGroup(group)
+	defer cancel()
+
+	for {
+		if len(s.groupMembers(group)) >= n {
+			return nil
+		}
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Converged reports whether every member of the ids is present and not leaving, such as the
+// peers a test just started.
+func (s *Serf) Converged(ids ...string) bool {
+	for _, id := range ids {
+		if m := s.loadMember(id); m == nil || m.IsLeaving() {
+			return false
+		}
+	}
+	return true
+}
+
+// Sync blocks until every member of the ids is present and not leaving, see Converged, or ctx is
+// done. Unlike WaitForGroup it waits for particular members, so a test can wait for the gossip
+// of the peers it started instead of sleeping. It returns ctx.Err() if ctx is done first.
+func (s *Serf) Sync(ctx context.Context, ids ...string) error {
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	for {
+		if s.Converged(ids...) {
+			return nil
+		}
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// groupMembers returns the members of the group, excluding the leaving ones.
+func (s *Serf) groupMembers(group string) []*Member {
+	members := make([]*Member, 0)
+	s.members.Range(func(key any, val any) bool {
+		if m := val.(*Member); m.Service.Group == group && !m.IsLeaving() {
+			members = append(members, m)
+		}
+		return true
+	})
+	return members
+}
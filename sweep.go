@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// eventInternal is the event type of the work the registry queues onto its own event loop.
+const eventInternal = serf.EventType(-1)
+
+// internalEvent is a function run on the event loop, so it is serialized with the serf events.
+type internalEvent func()
+
+// EventType implements serf.Event.
+func (e internalEvent) EventType() serf.EventType {
+	return eventInternal
+}
+
+// String implements serf.Event.
+func (e internalEvent) String() string {
+	return "internal"
+}
+
+// SetSweepInterval enables a periodic sweep that cross-checks the stored members against serf's
+// member list and evicts the members serf no longer knows about, calling the handler's OnMemberLeave.
+// An interval of zero, the default, disables the sweep. It must be called before Start.
+func (s *Serf) SetSweepInterval(d time.Duration) {
+	s.sweepInterval = d
+}
+
+// runSweeper queues a sweep on the event loop on every sweep interval until shutdown is closed.
+func (s *Serf) runSweeper(shutdown <-chan struct{}) {
+	ticker := s.newTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.queue.push(internalEvent(s.sweep))
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// sweep evicts the stored members that serf no longer reports as alive or leaving.
+func (s *Serf) sweep() {
+	known := make(map[string]struct{})
+	for _, member := range s.serf.Members() {
+		if member.Status == serf.StatusAlive || member.Status == serf.StatusLeaving {
+			known[member.Name] = struct{}{}
+		}
+	}
+
+	for _, m := range s.Members() {
+		name := m.Name
+		if name == "" {
+			name = m.Id
+		}
+		if _, ok := known[name]; ok || m.IsLeaving() || m.IsSuspect() {
+			continue
+		}
+
+		log.Printf("[INFO] serf sweep evicted stale member, id:%s, advertise:%s\n", m.Id, m.Advertise)
+		s.evict(m)
+	}
+}
+
+// evict removes a stored member as if it left, and tells the handler and the subscribers.
+func (s *Serf) evict(m *Member) {
+	seq := s.observe(serf.EventMemberLeave, m)
+	s.deleteMember(m.Id)
+	s.recount(m.Id, nil)
+	if err := s.dispatch(serf.EventMemberLeave, m); err != nil {
+		log.Printf("[ERROR] serf handle member leave err:%s\n", err.Error())
+	}
+	s.subscribers.publish(MemberEvent{Type: EventLeave, Member: m, Seq: seq}, nil)
+}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import "log"
+
+// reservedTags are the tags describing the service of the local member, ReplaceTags keeps them
+// unless they are given.
+var reservedTags = []string{TagGroup, TagAddr, TagReplicas, TagHealth}
+
+// UpdateTags sets the tags on the local member and gossips the resulting tag set to the cluster.
+// Tags that are not given keep their current values. It is the same as MergeTags.
+func (s *Serf) UpdateTags(tags map[string]string) error {
+	return s.MergeTags(tags)
+}
+
+// MergeTags sets the given tags on the local member, keeping the values of the tags that are
+// not given, and gossips the resulting tag set to the cluster in one update.
+// See ReplaceTags for how concurrent updates are applied.
+func (s *Serf) MergeTags(tags map[string]string) error {
+	_, err := s.MergeTagsIfChanged(tags)
+	return err
+}
+
+// MergeTagsIfChanged is like MergeTags, and returns whether the update was gossiped. An update
+// that leaves the gossiped tags unchanged is not gossiped, so tags driven by a noisy external
+// source don't cause cluster-wide updates, see ReplaceTags.
+func (s *Serf) MergeTagsIfChanged(tags map[string]string) (bool, error) {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+
+	desired := s.member.GetTags()
+	for k, v := range tags {
+		desired[k] = v
+	}
+	return s.applyTags(desired)
+}
+
+// ReplaceTags replaces all tags of the local member with the given tags and gossips them to the
+// cluster in one update. The group, addr, replicas and health tags keep their current values
+// unless they are given, as they describe the service of the member.
+// Tag updates are serialized, so concurrent callers don't clobber each other, and the local
+// member only reflects the new tags once serf has accepted them. An update leaving the gossiped
+// tags unchanged is not gossiped again.
+func (s *Serf) ReplaceTags(tags map[string]string) error {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+
+	current := s.member.GetTags()
+	desired := make(map[string]string, len(tags))
+	for _, k := range reservedTags {
+		if v, ok := current[k]; ok {
+			desired[k] = v
+		}
+	}
+	for k, v := range tags {
+		desired[k] = v
+	}
+	_, err := s.applyTags(desired)
+	return err
+}
+
+// applyTags gossips the desired tags, and sets them on the local member once serf has accepted them.
+// It returns false without gossiping if the local node already gossips the resulting tags.
+// It must be called with the tags lock held.
+func (s *Serf) applyTags(desired map[string]string) (bool, error) {
+	if s.serf == nil {
+		return false, ErrNotStarted
+	}
+
+	gossiped := make(map[string]string, len(desired))
+	for k, v := range desired {
+		gossiped[k] = v
+	}
+	gossiped = s.gossipTags(gossiped)
+	if sameTags(s.serf.LocalMember().Tags, gossiped) {
+		s.member.replaceTags(desired)
+		return false, nil
+	}
+
+	err := s.serf.SetTags(gossiped)
+	s.checkGossipedTags(desired, gossiped)
+	if err != nil {
+		return false, err
+	}
+	s.member.replaceTags(desired)
+	return true, nil
+}
+
+// sameTags returns true if the tags hold the same keys and values.
+func sameTags(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if val, ok := b[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
+// TagsRejectedFunc is called with the tags of a tag update the local node doesn't gossip.
+type TagsRejectedFunc func(attempted map[string]string)
+
+// OnTagsRejected sets the function called when the tags gossiped by the local node don't match
+// the tags of a tag update, such as tags exceeding the memberlist size limit, so that an update
+// peers never see doesn't go unnoticed. attempted are the tags of the update.
+// It must be called before Start.
+func (s *Serf) OnTagsRejected(fn TagsRejectedFunc) {
+	s.onTagsRejected = fn
+}
+
+// checkGossipedTags calls the OnTagsRejected function if the local node doesn't gossip the
+// gossiped tags after a tag update of the desired tags.
+func (s *Serf) checkGossipedTags(desired map[string]string, gossiped map[string]string) {
+	if sameTags(s.serf.LocalMember().Tags, gossiped) {
+		return
+	}
+
+	log.Printf("[WARN] serf tags of the local member are not gossiped, id:%s\n", s.member.Id)
+	if s.onTagsRejected != nil {
+		s.onTagsRejected(desired)
+	}
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultTagsFileInterval is the default interval of checking the tags file for changes.
+const DefaultTagsFileInterval = time.Second
+
+// SetTagsFile sets a file holding tags of the local member, which external tooling can rewrite
+// to set tags such as draining, replicas or version without restarting the process.
+// The file holds a JSON object of string keys and values, for example:
+//
+//	{"replicas": "200", "version": "1.2.0"}
+//
+// The tags are loaded on Start, and the file is checked for changes on the given interval,
+// DefaultTagsFileInterval if it is zero. Changed tags are merged like UpdateTags, tags removed
+// from the file keep their current values. On Start and on every reload, the tags are resolved
+// the same way, see SetTagsFromEnv. It must be called before Start.
+func (s *Serf) SetTagsFile(path string, interval time.Duration) {
+	s.tagsFile = path
+	s.tagsFileInterval = interval
+}
+
+// loadTagsFile reads the tags of the tags file.
+func loadTagsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTagsFile, err.Error())
+	}
+	tags := make(map[string]string)
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrTagsFile, path, err.Error())
+	}
+	return tags, nil
+}
+
+// desiredTags returns the tags of the local member merged with the tags of the tags file, if
+// there is one, and with the references to environment variables resolved if SetTagsFromEnv is
+// enabled. Start and the reloads of the tags file both apply these tags.
+func (s *Serf) desiredTags() (map[string]string, error) {
+	desired := s.member.GetTags()
+	if s.tagsFile != "" {
+		tags, err := loadTagsFile(s.tagsFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range tags {
+			desired[k] = v
+		}
+	}
+	if s.tagsFromEnv {
+		return resolveEnvTags(desired)
+	}
+	return desired, nil
+}
+
+// reloadTagsFile gossips the tags of the changed tags file.
+func (s *Serf) reloadTagsFile() error {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+
+	desired, err := s.desiredTags()
+	if err != nil {
+		return err
+	}
+	_, err = s.applyTags(desired)
+	return err
+}
+
+// runTagsFileWatcher applies the tags of the tags file whenever its modification time or size
+// changes, until shutdown is closed.
+func (s *Serf) runTagsFileWatcher(shutdown <-chan struct{}) {
+	interval := s.tagsFileInterval
+	if interval <= 0 {
+		interval = DefaultTagsFileInterval
+	}
+	ticker := s.newTicker(interval)
+	defer ticker.Stop()
+
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(s.tagsFile); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-ticker.C():
+			info, err := os.Stat(s.tagsFile)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+
+			if err := s.reloadTagsFile(); err != nil {
+				log.Printf("[ERROR] serf reload tags file:%s err:%s\n", s.tagsFile, err.Error())
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+func Test_FakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := registry.NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	after := clock.After(time.Second)
+	fired := 0
+	clock.AfterFunc(2*time.Second, func() { fired++ })
+	stopped := clock.AfterFunc(2*time.Second, func() { fired++ })
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-after)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+	assert.Equal(t, 0, fired)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, fired)
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	assert.Equal(t, start.Add(2*time.Second), clock.Now())
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker ticked")
+	default:
+	}
+}
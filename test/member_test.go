@@ -1,6 +1,8 @@
 package test
 
 import (
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +21,7 @@ func Test_NewMember(t *testing.T) {
 	m := registry.NewMember("test_id", "127.0.0.1:7031", "127.0.0.2:7031", "127.0.0.1:7030", "test_group", "127.0.0.1:80")
 	assert.NotNil(t, m)
 	assert.Equal(t, m.Id, "test_id")
+	assert.Equal(t, m.Name, "test_id")
 	assert.Equal(t, m.Service.Group, "test_group")
 	assert.Equal(t, m.Bind, "127.0.0.1:7031")
 	assert.Equal(t, m.Advertise, "127.0.0.2:7031")
@@ -125,3 +128,98 @@ func Test_MemberGetTags(t *testing.T) {
 		registry.TagReplicas: "10000",
 	}, tags)
 }
+
+func Test_NewMemberFromHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+
+	m, err := registry.NewMemberFromHostname("127.0.0.1:7031", "127.0.0.2:7031")
+	if registry.ValidateId(hostname) != nil {
+		assert.ErrorIs(t, err, registry.ErrInvalidId)
+		return
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, hostname, m.Id)
+	assert.Equal(t, hostname, m.Name)
+	assert.Equal(t, hostname, m.Service.Id)
+	assert.Equal(t, "127.0.0.1:7031", m.Bind)
+}
+
+func Test_NewMemberWithUUID(t *testing.T) {
+	m1 := registry.NewMemberWithUUID("127.0.0.1:7031", "127.0.0.2:7031")
+	m2 := registry.NewMemberWithUUID("127.0.0.1:7031", "127.0.0.2:7031")
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, m1.Id)
+	assert.NotEqual(t, m1.Id, m2.Id)
+	assert.Nil(t, registry.ValidateId(m1.Id))
+	assert.Equal(t, m1.Id, m1.Service.Id)
+}
+
+func Test_ValidateId(t *testing.T) {
+	assert.Nil(t, registry.ValidateId("web-1.prod"))
+	assert.ErrorIs(t, registry.ValidateId(""), registry.ErrInvalidId)
+	assert.ErrorIs(t, registry.ValidateId("web 1"), registry.ErrInvalidId)
+	assert.ErrorIs(t, registry.ValidateId(strings.Repeat("a", 129)), registry.ErrInvalidId)
+}
+
+func Test_MemberUsesTLS(t *testing.T) {
+	m := registry.NewMember("test_id", "127.0.0.1:7031", "127.0.0.2:7031", "127.0.0.1:7030", "test_group", "127.0.0.1:443")
+	assert.False(t, m.UsesTLS())
+	assert.Equal(t, "http", m.Scheme())
+
+	m.SetTag(registry.TagTLS, "true")
+	assert.True(t, m.UsesTLS())
+	assert.True(t, m.Service.TLS)
+	assert.Equal(t, "https", m.Scheme())
+
+	// The TLS flag of the service survives the payload stored on the hash ring.
+	payload, err := m.Marshal()
+	assert.Nil(t, err)
+	stored := &registry.Member{}
+	assert.Nil(t, stored.Unmarshal(payload))
+	assert.True(t, stored.Service.TLS)
+
+	m.SetTags(map[string]string{registry.TagTLS: "false"})
+	assert.False(t, m.UsesTLS())
+	assert.False(t, m.Service.TLS)
+}
+
+func Test_MemberEqualAndClone(t *testing.T) {
+	m := registry.NewMember("test_id", "127.0.0.1:7031", "127.0.0.2:7031", "127.0.0.1:7030", "test_group", "127.0.0.1:80")
+	m.SetTag("version", "1")
+	clone := m.Clone()
+	assert.True(t, m.Equal(clone))
+	assert.True(t, m.Equal(m))
+	assert.False(t, m.Equal(nil))
+
+	m.SetTag("version", "2")
+	assert.False(t, m.Equal(clone))
+	v, _ := clone.GetTag("version")
+	assert.Equal(t, "1", v)
+
+	clone = m.Clone()
+	clone.Status = registry.StatusLeaving
+	assert.False(t, m.Equal(clone))
+}
+
+func Test_MemberNilTags(t *testing.T) {
+	empty := &registry.Member{}
+	val, ok := empty.GetTag(registry.TagGroup)
+	assert.False(t, ok)
+	assert.Equal(t, "", val)
+	assert.NotNil(t, empty.GetTags())
+	empty.SetTags(nil)
+	assert.NotNil(t, empty.Clone().GetTags())
+
+	m := registry.NewMember("test_id", "127.0.0.1:7031", "127.0.0.2:7031", "127.0.0.1:7030", "test_group", "127.0.0.1:80")
+	m.SetTags(nil)
+	m.SetTags(map[string]string{"version": "1"})
+	assert.Equal(t, "test_group", m.Service.Group)
+	assert.Equal(t, "127.0.0.1:80", m.Service.Addr)
+	assert.Equal(t, registry.DefaultReplicas, m.Replicas)
+	assert.Equal(t, map[string]string{
+		registry.TagAddr:     "127.0.0.1:80",
+		registry.TagGroup:    "test_group",
+		registry.TagReplicas: "10000",
+		"version":            "1",
+	}, m.GetTags())
+}
@@ -0,0 +1,249 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+// fakeMetrics records the metrics reported to it.
+type fakeMetrics struct {
+	sync.Mutex
+	counters  map[string]int64
+	gauges    map[string]float64
+	durations map[string][]time.Duration
+	groups    map[string]int
+	services  map[string]int
+	handlers  map[string][]time.Duration
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		counters:  make(map[string]int64),
+		gauges:    make(map[string]float64),
+		durations: make(map[string][]time.Duration),
+		groups:    make(map[string]int),
+		services:  make(map[string]int),
+		handlers:  make(map[string][]time.Duration),
+	}
+}
+
+func (m *fakeMetrics) IncrCounter(name string, delta int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *fakeMetrics) SetGauge(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *fakeMetrics) ObserveDuration(name string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.durations[name] = append(m.durations[name], d)
+}
+
+func (m *fakeMetrics) SetGroupCount(group string, n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.groups[group] = n
+}
+
+func (m *fakeMetrics) SetServiceCount(service string, n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.services[service] = n
+}
+
+func (m *fakeMetrics) ObserveHandlerDuration(method string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.handlers[method] = append(m.handlers[method], d)
+}
+
+func (m *fakeMetrics) handlerSamples(method string) []time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return append([]time.Duration(nil), m.handlers[method]...)
+}
+
+func (m *fakeMetrics) counts() (map[string]int, map[string]int) {
+	m.Lock()
+	defer m.Unlock()
+	groups := make(map[string]int)
+	for k, v := range m.groups {
+		groups[k] = v
+	}
+	services := make(map[string]int)
+	for k, v := range m.services {
+		services[k] = v
+	}
+	return groups, services
+}
+
+func (m *fakeMetrics) counter(name string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[name]
+}
+
+func (m *fakeMetrics) gauge(name string) (float64, bool) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.gauges[name]
+	return v, ok
+}
+
+func (m *fakeMetrics) samples(name string) []time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return append([]time.Duration(nil), m.durations[name]...)
+}
+
+func Test_SerfMetrics(t *testing.T) {
+	metrics := newFakeMetrics()
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(&registry.BaseHandler{})
+	serf1.SetMetrics(metrics)
+	serf1.SetConvergenceTracking(true)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetConvergenceTracking(true)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	serf2.Stop()
+	time.Sleep(sleepTime)
+	serf1.Stop()
+
+	assert.Equal(t, int64(2), metrics.counter(registry.MetricMemberJoin))
+	assert.GreaterOrEqual(t, metrics.counter(registry.MetricMemberLeft), int64(1))
+	assert.GreaterOrEqual(t, len(metrics.samples(registry.MetricHandlerDispatch)), 3)
+	assert.Len(t, metrics.handlerSamples("OnMemberJoin"), 2)
+	assert.GreaterOrEqual(t, len(metrics.handlerSamples("OnMemberLeave")), 1)
+	assert.Len(t, metrics.samples(registry.MetricConvergence), 1)
+}
+
+func Test_SerfMemberCounts(t *testing.T) {
+	metrics := newFakeMetrics()
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetMetrics(metrics)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag(registry.TagService, "payments")
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	groups, services := metrics.counts()
+	assert.Equal(t, map[string]int{"test_group": 2}, groups)
+	assert.Equal(t, map[string]int{"payments": 1}, services)
+	assert.Equal(t, []string{"test_group"}, serf1.Groups())
+	assert.Equal(t, []string{"payments"}, serf1.Services())
+
+	serf2.Stop()
+	time.Sleep(sleepTime)
+	groups, services = metrics.counts()
+	assert.Equal(t, map[string]int{"test_group": 1}, groups)
+	assert.Equal(t, map[string]int{"payments": 0}, services)
+	assert.Equal(t, []string{}, serf1.Services())
+	serf1.Stop()
+}
+
+func Test_SerfJitter(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	assert.ErrorIs(t, s.SetJitter(-0.1), registry.ErrJitter)
+	assert.ErrorIs(t, s.SetJitter(1), registry.ErrJitter)
+	assert.Nil(t, s.SetJitter(0.5))
+
+	metrics := newFakeMetrics()
+	clock := &armingClock{FakeClock: registry.NewFakeClock(time.Now()), armed: make(chan time.Duration, 16)}
+	s.SetClock(clock)
+	s.SetMetrics(metrics)
+	s.SetStatsInterval(10 * time.Second)
+	err := s.Start()
+	assert.Nil(t, err)
+
+	// A period of 10s jittered by half is between 5s and 15s.
+	var period time.Duration
+	select {
+	case period = <-clock.armed:
+	case <-time.After(sleepTime * 10):
+		t.Fatal("the stats ticker was not armed")
+	}
+	assert.GreaterOrEqual(t, period, 5*time.Second)
+	assert.LessOrEqual(t, period, 15*time.Second)
+
+	// Nothing fires before the period, and the tick arms the next period within Advance.
+	clock.Advance(period - time.Millisecond)
+	assert.Empty(t, clock.armed)
+	clock.Advance(time.Millisecond)
+	assert.Len(t, clock.armed, 1)
+	assert.Eventually(t, func() bool {
+		v, ok := metrics.gauge(registry.MetricClusterMembers)
+		return ok && v == 1
+	}, sleepTime*10, sleepTime/10)
+	s.Stop()
+}
+
+// armingClock is a FakeClock reporting the delay of every timer armed on it.
+type armingClock struct {
+	*registry.FakeClock
+	armed chan time.Duration
+}
+
+func (c *armingClock) AfterFunc(d time.Duration, f func()) registry.Timer {
+	c.armed <- d
+	return c.FakeClock.AfterFunc(d, f)
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+// portMap forwards both the UDP and the TCP traffic of an address to another one,
+// like a NAT port map in front of a node.
+type portMap struct {
+	udp         net.PacketConn
+	tcp         net.Listener
+	udpPackets  atomic.Int64
+	tcpSessions atomic.Int64
+}
+
+func newPortMap(t *testing.T, from string, to string) *portMap {
+	udp, err := net.ListenPacket("udp", from)
+	assert.Nil(t, err)
+	tcp, err := net.Listen("tcp", from)
+	assert.Nil(t, err)
+	p := &portMap{udp: udp, tcp: tcp}
+
+	go func() {
+		target, _ := net.ResolveUDPAddr("udp", to)
+		out, err := net.DialUDP("udp", nil, target)
+		if err != nil {
+			return
+		}
+		defer out.Close()
+
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			p.udpPackets.Add(1)
+			out.Write(buf[:n])
+		}
+	}()
+
+	go func() {
+		for {
+			in, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			p.tcpSessions.Add(1)
+			go func() {
+				out, err := net.Dial("tcp", to)
+				if err != nil {
+					in.Close()
+					return
+				}
+				go func() {
+					io.Copy(out, in)
+					out.Close()
+				}()
+				io.Copy(in, out)
+				in.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *portMap) Close() {
+	p.udp.Close()
+	p.tcp.Close()
+}
+
+func Test_SerfAdvertiseBehindPortMap(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	pm := newPortMap(t, "127.0.0.1:7733", "127.0.0.1:7732")
+	defer pm.Close()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7732",
+		"127.0.0.1:7733",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	// Join serf1 back to serf2 through the port map, which goes over TCP.
+	err = serf1.Join([]string{"127.0.0.1:7733"})
+	assert.Nil(t, err)
+
+	// Wait for a few probe intervals, so that serf1 probes serf2 through the port map.
+	time.Sleep(2 * time.Second)
+
+	var found *registry.Member
+	for _, m := range serf1.Members() {
+		if m.Id == "test_id2" {
+			found = m
+		}
+	}
+	assert.NotNil(t, found)
+	assert.Equal(t, "127.0.0.1:7733", found.Advertise)
+	assert.Greater(t, pm.udpPackets.Load(), int64(0))
+	assert.Greater(t, pm.tcpSessions.Load(), int64(0))
+
+	serf2.Stop()
+	serf1.Stop()
+}
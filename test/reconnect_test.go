@@ -0,0 +1,321 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+// fastProbes makes memberlist detect failures within a second.
+func fastProbes(cfg *serf.Config) {
+	cfg.MemberlistConfig.ProbeInterval = 100 * time.Millisecond
+	cfg.MemberlistConfig.ProbeTimeout = 50 * time.Millisecond
+	cfg.MemberlistConfig.SuspicionMult = 1
+}
+
+func Test_SerfOnReconnecting(t *testing.T) {
+	var lock sync.Mutex
+	reconnecting := make(map[string]int)
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetSerfConfig(fastProbes)
+	serf1.SetReconnectInterval(sleepTime)
+	serf1.OnReconnecting(func(id string) {
+		lock.Lock()
+		defer lock.Unlock()
+		reconnecting[id]++
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	serf2, transport := startCrashable(t, "test_id2", 7731)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+
+	lock.Lock()
+	assert.Empty(t, reconnecting)
+	lock.Unlock()
+
+	// Closing the transport cuts serf2 off the network, so serf1 sees it fail instead of leave.
+	transport.Shutdown()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return reconnecting["test_id2"] >= 2
+	}, sleepTime*50, sleepTime)
+
+	lock.Lock()
+	assert.NotContains(t, reconnecting, "test_id1")
+	lock.Unlock()
+
+	serf1.Stop()
+	serf2.Stop()
+}
+
+// startCrashable starts a member whose transport can be shut down to crash it, so that its peers
+// see it fail instead of leave.
+func startCrashable(t *testing.T, id string, port int) (*registry.Serf, *memberlist.NetTransport) {
+	transport, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{"127.0.0.1"},
+		BindPort:  port,
+	})
+	assert.Nil(t, err)
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	s := registry.NewSerf(registry.NewMember(id, addr, addr, "127.0.0.1:7730", "test_group", addr))
+	s.SetSerfConfig(func(cfg *serf.Config) {
+		fastProbes(cfg)
+		cfg.MemberlistConfig.Transport = transport
+	})
+	assert.Nil(t, s.Start())
+	return s, transport
+}
+
+func Test_SerfFailedGrace(t *testing.T) {
+	handler := &orderHandler{}
+	clock := registry.NewFakeClock(time.Now())
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	metrics := newFakeMetrics()
+	audit := &bytes.Buffer{}
+	serf1.SetHandler(handler)
+	serf1.SetMetrics(metrics)
+	serf1.SetAuditWriter(audit)
+	serf1.SetClock(clock)
+	serf1.SetFailedGrace(time.Minute)
+	serf1.SetDeadNodeReclaimTime(time.Millisecond)
+	serf1.SetSerfConfig(fastProbes)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	status := func(id string) registry.MemberStatus {
+		for _, m := range serf1.Members() {
+			if m.Id == id {
+				return m.Status
+			}
+		}
+		return ""
+	}
+	events := func() []string {
+		handler.Lock()
+		defer handler.Unlock()
+		return append([]string(nil), handler.events...)
+	}
+
+	serf2, transport2 := startCrashable(t, "test_id2", 7731)
+	assert.Eventually(t, func() bool {
+		return status("test_id2") == registry.StatusAlive
+	}, sleepTime*10, sleepTime/2)
+
+	// The failed member is kept as suspect and is still selected.
+	transport2.Shutdown()
+	assert.Eventually(t, func() bool {
+		return status("test_id2") == registry.StatusSuspect
+	}, sleepTime*50, sleepTime/2)
+	m, err := serf1.PickExcept("test_group", "test_id1")
+	assert.Nil(t, err)
+	assert.Equal(t, "test_id2", m.Id)
+	assert.NotContains(t, events(), "leave:test_id2")
+
+	// Rejoining within the grace window is an update, and the grace expiry is a no-op.
+	serf3, transport3 := startCrashable(t, "test_id2", 7732)
+	assert.Eventually(t, func() bool {
+		return status("test_id2") == registry.StatusAlive
+	}, sleepTime*50, sleepTime/2)
+	clock.Advance(time.Minute)
+	time.Sleep(sleepTime)
+	assert.Equal(t, []string{"join:test_id1", "join:test_id2", "update:test_id2"}, events())
+
+	// The rejoin is counted as a recovery, not as a join.
+	assert.Equal(t, int64(2), metrics.counter(registry.MetricMemberJoin))
+	assert.Equal(t, int64(1), metrics.counter(registry.MetricMemberRecovered))
+	assert.Equal(t, int64(0), metrics.counter(registry.MetricMemberFailed))
+
+	// A member that doesn't rejoin is handled as failed once the grace window has passed.
+	transport3.Shutdown()
+	assert.Eventually(t, func() bool {
+		return status("test_id2") == registry.StatusSuspect
+	}, sleepTime*50, sleepTime/2)
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		return status("test_id2") == ""
+	}, sleepTime*10, sleepTime/2)
+	assert.Equal(t, "leave:test_id2", events()[len(events())-1])
+	assert.Equal(t, int64(1), metrics.counter(registry.MetricMemberFailed))
+
+	serf1.Stop()
+	serf3.Stop()
+	serf2.Stop()
+
+	var joins, recoveries int
+	decoder := json.NewDecoder(audit)
+	for decoder.More() {
+		var r registry.AuditRecord
+		assert.Nil(t, decoder.Decode(&r))
+		if r.Id != "test_id2" {
+			continue
+		}
+		if r.Event == "member-join" {
+			joins++
+		}
+		if r.Event == "member-update" && r.Recovered {
+			recoveries++
+		}
+	}
+	assert.Equal(t, 1, joins)
+	assert.Equal(t, 1, recoveries)
+}
+
+// partitionTransport is a transport that drops every packet and stream, in and out, while it is cut.
+type partitionTransport struct {
+	*memberlist.NetTransport
+	cut     atomic.Bool
+	packets chan *memberlist.Packet
+	streams chan net.Conn
+}
+
+func newPartitionTransport(t *testing.T, port int) *partitionTransport {
+	transport, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{"127.0.0.1"},
+		BindPort:  port,
+	})
+	assert.Nil(t, err)
+
+	p := &partitionTransport{
+		NetTransport: transport,
+		packets:      make(chan *memberlist.Packet),
+		streams:      make(chan net.Conn),
+	}
+	go func() {
+		for packet := range transport.PacketCh() {
+			if !p.cut.Load() {
+				p.packets <- packet
+			}
+		}
+	}()
+	go func() {
+		for conn := range transport.StreamCh() {
+			if p.cut.Load() {
+				conn.Close()
+				continue
+			}
+			p.streams <- conn
+		}
+	}()
+	return p
+}
+
+func (p *partitionTransport) PacketCh() <-chan *memberlist.Packet {
+	return p.packets
+}
+
+func (p *partitionTransport) StreamCh() <-chan net.Conn {
+	return p.streams
+}
+
+func (p *partitionTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return p.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+func (p *partitionTransport) WriteToAddress(b []byte, a memberlist.Address) (time.Time, error) {
+	if p.cut.Load() {
+		return time.Now(), nil
+	}
+	return p.NetTransport.WriteToAddress(b, a)
+}
+
+func (p *partitionTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return p.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+func (p *partitionTransport) DialAddressTimeout(a memberlist.Address, timeout time.Duration) (net.Conn, error) {
+	if p.cut.Load() {
+		return nil, errors.New("partitioned")
+	}
+	return p.NetTransport.DialAddressTimeout(a, timeout)
+}
+
+func Test_SerfSelfFailed(t *testing.T) {
+	failed := make(chan struct{}, 4)
+	rejoined := make(chan struct{}, 4)
+	transport := newPartitionTransport(t, 7730)
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetSerfConfig(func(cfg *serf.Config) {
+		fastProbes(cfg)
+		cfg.ReconnectInterval = sleepTime
+		cfg.MemberlistConfig.Transport = transport
+	})
+	serf1.OnSelfFailed(func() {
+		failed <- struct{}{}
+	})
+	serf1.OnSelfRejoined(func() {
+		rejoined <- struct{}{}
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	serf2, _ := startCrashable(t, "test_id2", 7731)
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 2
+	}, sleepTime*10, sleepTime/2)
+
+	// A partition makes the peer declare the local node dead, which it refutes once healed.
+	transport.cut.Store(true)
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 1
+	}, sleepTime*50, sleepTime/2)
+	assert.Empty(t, failed)
+	transport.cut.Store(false)
+
+	select {
+	case <-failed:
+	case <-time.After(sleepTime * 50):
+		t.Fatal("the self failed function was not called")
+	}
+	select {
+	case <-rejoined:
+	case <-time.After(sleepTime * 50):
+		t.Fatal("the self rejoined function was not called")
+	}
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 2
+	}, sleepTime*50, sleepTime/2)
+	assert.Empty(t, failed)
+
+	serf2.Stop()
+	serf1.Stop()
+}
@@ -1,7 +1,9 @@
 package test
 
 import (
+	"context"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
@@ -80,7 +82,7 @@ func Test_RegistryOnMemberJoin(t *testing.T) {
 		serviceGroup,
 		serviceAddr,
 	)
-	err := r.OnMemberJoin(member)
+	err := r.OnMemberJoin(context.Background(), member)
 	assert.Nil(t, err)
 
 	service, err := r.Match(serviceGroup, "xxx")
@@ -116,10 +118,10 @@ func Test_RegistryOnMemberLeave(t *testing.T) {
 		serviceGroup,
 		serviceAddr,
 	)
-	err := r.OnMemberJoin(member)
+	err := r.OnMemberJoin(context.Background(), member)
 	assert.Nil(t, err)
 
-	err = r.OnMemberLeave(member)
+	err = r.OnMemberLeave(context.Background(), member)
 	assert.Nil(t, err)
 
 	service, err := r.Match(serviceGroup, "xxx")
@@ -153,14 +155,14 @@ func Test_RegistryOnMemberUpdate(t *testing.T) {
 		serviceAddr,
 	)
 
-	err := r.OnMemberJoin(member)
+	err := r.OnMemberJoin(context.Background(), member)
 	assert.Nil(t, err)
 	service, err := r.Match(serviceGroup, "xxx")
 	assert.Nil(t, err)
 	assert.Equal(t, serviceAddr, service.Addr)
 
 	member.Service.Addr = "127.0.0.1:81"
-	err = r.OnMemberUpdate(member)
+	err = r.OnMemberUpdate(context.Background(), member)
 	assert.Nil(t, err)
 
 	service, err = r.Match(serviceGroup, "xxx")
@@ -193,7 +195,7 @@ func Test_RegistryMatch(t *testing.T) {
 		serviceGroup,
 		"127.0.0.1:80",
 	)
-	err := r.OnMemberJoin(member1)
+	err := r.OnMemberJoin(context.Background(), member1)
 	assert.Nil(t, err)
 
 	member2 := registry.NewMember(
@@ -204,7 +206,7 @@ func Test_RegistryMatch(t *testing.T) {
 		serviceGroup,
 		"127.0.0.1:81",
 	)
-	err = r.OnMemberJoin(member2)
+	err = r.OnMemberJoin(context.Background(), member2)
 	assert.Nil(t, err)
 
 	service, err := r.Match(serviceGroup, "werben")
@@ -246,7 +248,7 @@ func Test_RegistryMembers(t *testing.T) {
 		serviceGroup,
 		"127.0.0.1:80",
 	)
-	err := r.OnMemberJoin(member1)
+	err := r.OnMemberJoin(context.Background(), member1)
 	assert.Nil(t, err)
 
 	member2 := registry.NewMember(
@@ -257,7 +259,7 @@ func Test_RegistryMembers(t *testing.T) {
 		serviceGroup,
 		"127.0.0.1:81",
 	)
-	err = r.OnMemberJoin(member2)
+	err = r.OnMemberJoin(context.Background(), member2)
 	assert.Nil(t, err)
 
 	services := r.Members(serviceGroup)
@@ -272,3 +274,167 @@ func Test_RegistryMembers(t *testing.T) {
 	}, services)
 	r.Close()
 }
+
+func Test_RegistryOnRingChange(t *testing.T) {
+	r := registry.New([]registry.IOption{
+		registry.OptId("testid"),
+		registry.OptBind("127.0.0.1:7370"),
+		registry.OptBindAdvertise("127.0.0.1:7370"),
+		registry.OptRegistries(""),
+		registry.OptAddr("127.0.0.1:9000"),
+		registry.OptAdvertise("127.0.0.1:9000"),
+	})
+
+	serviceGroup := "ringgroup"
+	var olds, latests [][]*registry.Service
+	r.OnRingChange(func(group string, old []*registry.Service, latest []*registry.Service) {
+		if group == serviceGroup {
+			olds = append(olds, old)
+			latests = append(latests, latest)
+		}
+	})
+
+	member := registry.NewMember(
+		"testid1",
+		"127.0.0.1:8370",
+		"127.0.0.1:8370",
+		"127.0.0.1:7370",
+		serviceGroup,
+		"127.0.0.1:80",
+	)
+	err := r.OnMemberJoin(context.Background(), member)
+	assert.Nil(t, err)
+
+	// An update leaving the services unchanged doesn't report a ring change.
+	err = r.OnMemberUpdate(context.Background(), member)
+	assert.Nil(t, err)
+	assert.Len(t, olds, 1)
+
+	err = r.OnMemberLeave(context.Background(), member)
+	assert.Nil(t, err)
+
+	assert.Len(t, olds, 2)
+	assert.Len(t, olds[0], 0)
+	assert.EqualValues(t, []*registry.Service{&member.Service}, latests[0])
+	assert.EqualValues(t, []*registry.Service{&member.Service}, olds[1])
+	assert.Len(t, latests[1], 0)
+	r.Close()
+}
+
+func Test_RegistryRingOwnership(t *testing.T) {
+	r := registry.New([]registry.IOption{
+		registry.OptId("registy-id"),
+		registry.OptBind("127.0.0.1:7370"),
+		registry.OptBindAdvertise("127.0.0.1:7370"),
+		registry.OptRegistries(""),
+		registry.OptAddr("127.0.0.1:9000"),
+		registry.OptAdvertise("127.0.0.1:9000"),
+	})
+
+	serviceGroup := "testgroup"
+	assert.Empty(t, r.RingOwnership(serviceGroup))
+	for i, id := range []string{"testid1", "testid2", "testid3"} {
+		member := registry.NewMember(
+			id,
+			"127.0.0.1:"+strconv.Itoa(8370+i),
+			"127.0.0.1:"+strconv.Itoa(8370+i),
+			"127.0.0.1:7370",
+			serviceGroup,
+			"127.0.0.1:"+strconv.Itoa(80+i),
+		)
+		member.Replicas = "100"
+		err := r.OnMemberJoin(context.Background(), member)
+		assert.Nil(t, err)
+	}
+
+	ownership := r.RingOwnership(serviceGroup)
+	assert.Len(t, ownership, 3)
+	total := 0.0
+	for _, fraction := range ownership {
+		total += fraction
+	}
+	assert.InDelta(t, 1.0, total, 1e-9)
+
+	// The ownership matches the share of keys Owner and Match assign to each member.
+	keys := 20000
+	owned := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		owner, err := r.Owner(serviceGroup, key)
+		assert.Nil(t, err)
+		service, err := r.Match(serviceGroup, key)
+		assert.Nil(t, err)
+		assert.Equal(t, service.Id, owner.Id)
+		owned[owner.Id]++
+	}
+	for id, fraction := range ownership {
+		assert.InDelta(t, fraction, float64(owned[id])/float64(keys), 0.02, id)
+	}
+
+	_, err := r.Owner("unknown", "key")
+	assert.NotNil(t, err)
+	r.Close()
+}
+
+func Test_RegistryMatchBounded(t *testing.T) {
+	r := registry.New([]registry.IOption{
+		registry.OptId("registy-id"),
+		registry.OptBind("127.0.0.1:7370"),
+		registry.OptBindAdvertise("127.0.0.1:7370"),
+		registry.OptRegistries(""),
+		registry.OptAddr("127.0.0.1:9000"),
+		registry.OptAdvertise("127.0.0.1:9000"),
+		registry.OptLoadFactor(1.25),
+	})
+
+	serviceGroup := "testgroup"
+	_, _, err := r.MatchBounded(serviceGroup, "key")
+	assert.NotNil(t, err)
+	assert.Empty(t, r.RingLoad(serviceGroup))
+	for i, id := range []string{"testid1", "testid2", "testid3"} {
+		member := registry.NewMember(
+			id,
+			"127.0.0.1:"+strconv.Itoa(8370+i),
+			"127.0.0.1:"+strconv.Itoa(8370+i),
+			"127.0.0.1:7370",
+			serviceGroup,
+			"127.0.0.1:"+strconv.Itoa(80+i),
+		)
+		member.Replicas = "100"
+		err := r.OnMemberJoin(context.Background(), member)
+		assert.Nil(t, err)
+	}
+
+	// Without load, a key goes to its owner.
+	owner, err := r.Match(serviceGroup, "hot")
+	assert.Nil(t, err)
+	service, release, err := r.MatchBounded(serviceGroup, "hot")
+	assert.Nil(t, err)
+	assert.Equal(t, owner.Id, service.Id)
+	release()
+	release()
+	assert.Equal(t, map[string]int{"testid1": 0, "testid2": 0, "testid3": 0}, r.RingLoad(serviceGroup))
+
+	// A hot key spills over once its owner reaches the bound.
+	releases := make([]func(), 0)
+	for i := 0; i < 30; i++ {
+		_, release, err := r.MatchBounded(serviceGroup, "hot")
+		assert.Nil(t, err)
+		releases = append(releases, release)
+	}
+	load := r.RingLoad(serviceGroup)
+	assert.Len(t, load, 3)
+	total := 0
+	for _, n := range load {
+		assert.LessOrEqual(t, n, 13)
+		total += n
+	}
+	assert.Equal(t, 30, total)
+	assert.Equal(t, 13, load[owner.Id])
+
+	for _, release := range releases {
+		release()
+	}
+	assert.Equal(t, map[string]int{"testid1": 0, "testid2": 0, "testid3": 0}, r.RingLoad(serviceGroup))
+	r.Close()
+}
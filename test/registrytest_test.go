@@ -0,0 +1,25 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+	"github.com/werbenhu/registry/registrytest"
+)
+
+func Test_StartTestCluster(t *testing.T) {
+	configured := make([]int, 0)
+	nodes := registrytest.StartTestCluster(t, 3, func(i int, s *registry.Serf) {
+		configured = append(configured, i)
+	})
+
+	assert.Equal(t, []int{0, 1, 2}, configured)
+	assert.Len(t, nodes, 3)
+	for _, node := range nodes {
+		assert.Len(t, node.Members(), 3)
+	}
+	m, err := nodes[2].PickExcept(registrytest.Group, "node-0", "node-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", m.Id)
+}
@@ -0,0 +1,372 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+	"github.com/werbenhu/registry/registrytest"
+)
+
+func Test_SerfPickExcept(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	for i := 0; i < 10; i++ {
+		m, err := serf1.PickExcept("test_group", "test_id1")
+		assert.Nil(t, err)
+		assert.Equal(t, "test_id2", m.Id)
+	}
+
+	_, err = serf1.PickExcept("test_group", "test_id1", "test_id2")
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+	_, err = serf1.PickExcept("other_group")
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SmoothWRR(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	member1.Replicas = "5"
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.Replicas = "1"
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	member3 := registry.NewMember(
+		"test_id3",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:82",
+	)
+	member3.Replicas = "1"
+	serf3 := registry.NewSerf(member3)
+	err = serf3.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	// The weights 5, 1, 1 are spread as a, a, b, a, c, a, a by nginx.
+	wrr := registry.NewSmoothWRR(serf1)
+	picks := make([]string, 0)
+	for i := 0; i < 14; i++ {
+		m, err := wrr.Next("test_group")
+		assert.Nil(t, err)
+		picks = append(picks, m.Id)
+	}
+	window := []string{"test_id1", "test_id1", "test_id2", "test_id1", "test_id3", "test_id1", "test_id1"}
+	assert.Equal(t, append(window, window...), picks)
+
+	_, err = wrr.Next("other_group")
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+
+	serf3.Stop()
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfPickCtx(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	// No member of the group shows up before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), sleepTime)
+	defer cancel()
+	_, err = serf1.PickCtx(ctx, "other_group")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	m, err := serf1.PickCtx(context.Background(), "test_group")
+	assert.Nil(t, err)
+	assert.Equal(t, "test_id1", m.Id)
+
+	// The pick waits for the member that joins.
+	picked := make(chan *registry.Member, 1)
+	go func() {
+		m, err := serf1.PickCtx(context.Background(), "test_group", "test_id1")
+		assert.Nil(t, err)
+		picked <- m
+	}()
+	go func() {
+		m, err := registry.NewSmoothWRR(serf1).NextCtx(context.Background(), "other_group")
+		assert.Nil(t, err)
+		picked <- m
+	}()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	member3 := registry.NewMember(
+		"test_id3",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		"127.0.0.1:7730",
+		"other_group",
+		"127.0.0.1:82",
+	)
+	serf3 := registry.NewSerf(member3)
+	err = serf3.Start()
+	assert.Nil(t, err)
+
+	ids := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-picked:
+			ids = append(ids, m.Id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no member is picked")
+		}
+	}
+	assert.ElementsMatch(t, []string{"test_id2", "test_id3"}, ids)
+
+	serf3.Stop()
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfMinHealthy(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetHealthDebounce(sleepTime)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	serf1.SetMinHealthy("test_group", 2)
+	_, err = serf1.PickExcept("test_group")
+	assert.Nil(t, err)
+
+	// A failing member doesn't count as healthy.
+	serf2.ReportHealth(registry.HealthFail)
+	assert.Eventually(t, func() bool {
+		_, err := serf1.PickExcept("test_group")
+		return errors.Is(err, registry.ErrServiceDegraded)
+	}, 5*time.Second, sleepTime)
+	_, err = registry.NewSmoothWRR(serf1).Next("test_group")
+	assert.ErrorIs(t, err, registry.ErrServiceDegraded)
+	_, err = serf1.PickCtx(context.Background(), "test_group")
+	assert.ErrorIs(t, err, registry.ErrServiceDegraded)
+
+	serf1.SetMinHealthy("test_group", 0)
+	_, err = serf1.PickExcept("test_group")
+	assert.Nil(t, err)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfPicker(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3)
+
+	picks := func(seed int64) []string {
+		picker := registry.NewPicker(nodes[0], rand.NewSource(seed))
+		ids := make([]string, 0)
+		for i := 0; i < 10; i++ {
+			m, err := picker.PickExcept(registrytest.Group)
+			assert.Nil(t, err)
+			ids = append(ids, m.Id)
+			m, err = picker.PickWeighted(registrytest.Group)
+			assert.Nil(t, err)
+			ids = append(ids, m.Id)
+			members, err := picker.PickN(registrytest.Group, 2)
+			assert.Nil(t, err)
+			assert.NotEqual(t, members[0].Id, members[1].Id)
+			ids = append(ids, members[0].Id, members[1].Id)
+		}
+		return ids
+	}
+	assert.Equal(t, picks(1), picks(1))
+
+	members, err := nodes[0].PickN(registrytest.Group, 3)
+	assert.Nil(t, err)
+	assert.Len(t, members, 3)
+	_, err = nodes[0].PickN(registrytest.Group, 4)
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+	_, err = nodes[0].PickWeighted("other_group")
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+}
+
+func Test_SerfStrategy(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3)
+	group := registrytest.Group
+
+	m, err := nodes[0].Pick(group, "")
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+
+	nodes[0].SetStrategy(group, registry.StrategyRoundRobin)
+	ids := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		m, err := nodes[0].Pick(group, "")
+		assert.Nil(t, err)
+		ids = append(ids, m.Id)
+	}
+	assert.Equal(t, []string{"node-0", "node-1", "node-2", "node-0", "node-1", "node-2"}, ids)
+
+	nodes[0].SetStrategy(group, registry.StrategyConsistentHash)
+	first, err := nodes[0].Pick(group, "user-42")
+	assert.Nil(t, err)
+	nodes[1].SetStrategy(group, registry.StrategyConsistentHash)
+	for i := 0; i < 10; i++ {
+		m, err := nodes[1].Pick(group, "user-42")
+		assert.Nil(t, err)
+		assert.Equal(t, first.Id, m.Id)
+	}
+
+	nodes[0].SetStrategy(group, registry.StrategyWeighted)
+	_, err = nodes[0].Pick(group, "")
+	assert.Nil(t, err)
+
+	nodes[0].SetStrategy(group, registry.StrategyNearest)
+	_, err = nodes[0].Pick(group, "")
+	assert.Nil(t, err)
+
+	nodes[0].SetStrategy(group, registry.StrategyP2C)
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{registry.TagLoad: "100"}))
+	assert.Nil(t, nodes[2].UpdateTags(map[string]string{registry.TagLoad: "0"}))
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag(registry.TagLoad, "100")) == 1 &&
+			len(nodes[0].MembersByTag(registry.TagLoad, "0")) == 1
+	}, time.Second, sleepTime)
+	for i := 0; i < 20; i++ {
+		m, err := nodes[0].Pick(group, "")
+		assert.Nil(t, err)
+		assert.NotEqual(t, "node-1", m.Id)
+	}
+
+	_, err = nodes[0].Pick("other_group", "key")
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+	assert.Equal(t, "p2c", registry.StrategyP2C.String())
+}
+
+func Test_SerfPickNDraining(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3, func(i int, s *registry.Serf) {
+		s.SetHealthDebounce(10 * time.Millisecond)
+	})
+	group := registrytest.Group
+
+	assert.Nil(t, nodes[2].UpdateTags(map[string]string{registry.TagDraining: "true"}))
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag(registry.TagDraining, "true")) == 1
+	}, time.Second, sleepTime)
+
+	for i := 0; i < 10; i++ {
+		members, err := nodes[0].PickN(group, 2)
+		assert.Nil(t, err)
+		for _, m := range members {
+			assert.NotEqual(t, "node-2", m.Id)
+		}
+	}
+	_, err := nodes[0].PickN(group, 3)
+	assert.ErrorIs(t, err, registry.ErrNotEnoughEligible)
+	members, err := nodes[0].PickNWith(group, 3, registry.PickIncludeDraining)
+	assert.Nil(t, err)
+	assert.Len(t, members, 3)
+	assert.Equal(t, "node-2", members[2].Id)
+	_, err = nodes[0].PickNWith(group, 4, registry.PickIncludeDraining)
+	assert.ErrorIs(t, err, registry.ErrNoMember)
+
+	nodes[1].ReportHealth(registry.HealthFail)
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag(registry.TagHealth, string(registry.HealthFail))) == 1
+	}, time.Second, sleepTime)
+	_, err = nodes[0].PickNWith(group, 3, registry.PickIncludeDraining)
+	assert.ErrorIs(t, err, registry.ErrNotEnoughEligible)
+	members, err = nodes[0].PickNWith(group, 3, registry.PickIncludeDraining|registry.PickIncludeUnhealthy)
+	assert.Nil(t, err)
+	assert.Len(t, members, 3)
+	// A negative count is rejected instead of panicking.
+	_, err = nodes[0].PickN(group, -1)
+	assert.ErrorIs(t, err, registry.ErrPickCount)
+	_, err = nodes[0].PickNWith(group, -1, registry.PickIncludeDraining)
+	assert.ErrorIs(t, err, registry.ErrPickCount)
+	_, err = registry.NewPicker(nodes[0], rand.NewSource(1)).PickN(group, -1)
+	assert.ErrorIs(t, err, registry.ErrPickCount)
+	members, err = nodes[0].PickN(group, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+}
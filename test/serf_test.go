@@ -1,12 +1,29 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
 	"github.com/stretchr/testify/assert"
 	"github.com/werbenhu/registry"
+	"github.com/werbenhu/registry/registrytest"
 )
 
 func Test_NewSerf(t *testing.T) {
@@ -96,3 +113,2624 @@ func Test_SerfMembers(t *testing.T) {
 	serf1.Stop()
 	serf2.Stop()
 }
+
+func Test_SerfRangeMembers(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	visited := 0
+	serf1.RangeMembers(func(m *registry.Member) bool {
+		visited++
+		return true
+	})
+	assert.Equal(t, 2, visited)
+
+	visited = 0
+	serf1.RangeMembers(func(m *registry.Member) bool {
+		visited++
+		return false
+	})
+	assert.Equal(t, 1, visited)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfSerfMembers(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	assert.Nil(t, serf1.SerfMembers())
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	serf2.Stop()
+	time.Sleep(sleepTime)
+
+	// serf still knows the left member, which the registry no longer routes on.
+	status := make(map[string]serf.MemberStatus)
+	for _, m := range serf1.SerfMembers() {
+		status[m.Name] = m.Status
+	}
+	assert.Equal(t, serf.StatusLeft, status["test_id2"])
+	assert.Len(t, serf1.Members(), 1)
+	serf1.Stop()
+}
+
+func Test_SerfAddressResolver(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetAddressResolver(func(m *serf.Member) string {
+		port, ok := m.Tags["http_port"]
+		if !ok {
+			return ""
+		}
+		return net.JoinHostPort(m.Addr.String(), port)
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag("http_port", "8081")
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	addrs := make(map[string]string)
+	for _, m := range serf1.Members() {
+		addrs[m.Id] = m.Service.Addr
+	}
+	assert.Equal(t, map[string]string{
+		"test_id1": "127.0.0.1:80",
+		"test_id2": "127.0.0.1:8081",
+	}, addrs)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfMembersByTag(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	member1.SetTag("zone", "a")
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag("zone", "b")
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	zoneB := serf1.MembersByTag("zone", "b")
+	assert.Len(t, zoneB, 1)
+	assert.Equal(t, "test_id2", zoneB[0].Id)
+	assert.Len(t, serf1.MembersByTag(registry.TagGroup, "test_group"), 2)
+	assert.Len(t, serf1.MembersByTag("zone", "c"), 0)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfFindMembers(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3)
+
+	scanned := 0
+	found := nodes[0].FindMembers(1, func(m *registry.Member) bool {
+		scanned++
+		return true
+	})
+	assert.Len(t, found, 1)
+	assert.Equal(t, 1, scanned)
+
+	others := func(m *registry.Member) bool {
+		return m.Id != "node-0"
+	}
+	assert.Len(t, nodes[0].FindMembers(5, others), 2)
+	assert.Len(t, nodes[0].FindMembers(0, others), 2)
+	assert.Empty(t, nodes[0].FindMembers(2, func(m *registry.Member) bool {
+		return false
+	}))
+}
+
+func Test_SerfAuditWriter(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	buf := &bytes.Buffer{}
+	serf1 := registry.NewSerf(member1)
+	serf1.SetAuditWriter(buf)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	serf2.Stop()
+	time.Sleep(sleepTime)
+	serf1.Stop()
+
+	records := make([]registry.AuditRecord, 0)
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var r registry.AuditRecord
+		assert.Nil(t, decoder.Decode(&r))
+		records = append(records, r)
+	}
+
+	events := make(map[string]string)
+	for _, r := range records {
+		events[r.Id+" "+r.Event] = r.Addr
+	}
+	assert.Equal(t, "127.0.0.1:7730", events["test_id1 member-join"])
+	assert.Equal(t, "127.0.0.1:7731", events["test_id2 member-join"])
+	assert.Equal(t, "127.0.0.1:7731", events["test_id2 member-leave"])
+}
+
+func Test_SerfSetProtocolVersion(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+
+	serf := registry.NewSerf(member)
+	assert.Equal(t, registry.ErrProtocolVersion, serf.SetProtocolVersion(1))
+	assert.Equal(t, registry.ErrProtocolVersion, serf.SetProtocolVersion(6))
+	assert.Nil(t, serf.SetProtocolVersion(4))
+
+	err := serf.Start()
+	assert.Nil(t, err)
+	serf.Stop()
+}
+
+func Test_SerfMemberName(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.Name = "node-2"
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	var found *registry.Member
+	for _, m := range serf1.Members() {
+		if m.Id == "test_id2" {
+			found = m
+		}
+	}
+	assert.NotNil(t, found)
+	assert.Equal(t, "node-2", found.Name)
+	assert.Equal(t, "127.0.0.1:81", found.Service.Addr)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfSweepKeepsAliveMembers(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetSweepInterval(sleepTime / 4)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime * 2)
+
+	assert.Len(t, serf1.Members(), 2)
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfNameConflict(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_dup",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	member2 := registry.NewMember(
+		"test_dup",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.ErrorIs(t, err, registry.ErrNameConflict)
+	serf2.Stop()
+
+	member3 := registry.NewMember(
+		"test_dup",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:82",
+	)
+	serf3 := registry.NewSerf(member3)
+	serf3.SetNameConflictPolicy(registry.NameConflictSuffix)
+	err = serf3.Start()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(serf3.LocalMember().Id, "test_dup-"))
+	time.Sleep(sleepTime)
+
+	assert.Len(t, serf1.Members(), 2)
+	serf3.Stop()
+	serf1.Stop()
+}
+
+// countingAlive counts the alive messages passed to it.
+type countingAlive struct {
+	n atomic.Int64
+}
+
+// NotifyAlive implements memberlist.AliveDelegate.
+func (c *countingAlive) NotifyAlive(node *memberlist.Node) error {
+	c.n.Add(1)
+	return nil
+}
+
+func Test_SerfStartEmptyAdvertiseHost(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		":7730",
+		":7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf := registry.NewSerf(member)
+
+	// The local alive message comes from the address memberlist resolved, not a conflict.
+	started := make(chan error, 1)
+	go func() {
+		started <- serf.Start()
+	}()
+	select {
+	case err := <-started:
+		assert.Nil(t, err)
+	case <-time.After(sleepTime * 50):
+		t.Fatal("start with an empty advertise host did not return")
+	}
+	assert.Len(t, serf.Members(), 1)
+	serf.Stop()
+}
+
+func Test_SerfNameConflictDelegates(t *testing.T) {
+	member1 := registry.NewMember("test_dup", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	serf1.SetClusterId("test_cluster")
+	assert.Nil(t, serf1.Start())
+
+	// The conflict is seen by the merge delegate when serf owns the alive delegate.
+	member2 := registry.NewMember("test_dup", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	serf2.SetClusterId("test_cluster")
+	assert.ErrorIs(t, serf2.Start(), registry.ErrNameConflict)
+	serf2.Stop()
+	serf1.Stop()
+
+	// The alive delegate of the caller still sees the alive messages.
+	member1 = registry.NewMember("test_dup", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 = registry.NewSerf(member1)
+	assert.Nil(t, serf1.Start())
+	alive := &countingAlive{}
+	member2 = registry.NewMember("test_dup", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 = registry.NewSerf(member2)
+	serf2.SetSerfConfig(func(cfg *serf.Config) {
+		cfg.MemberlistConfig.Alive = alive
+	})
+	assert.ErrorIs(t, serf2.Start(), registry.ErrNameConflict)
+	assert.Positive(t, alive.n.Load())
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfWaitForGroup(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, serf1.WaitForGroup(ctx, "test_group", 1))
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		time.Sleep(sleepTime)
+		member2 := registry.NewMember(
+			"test_id2",
+			"127.0.0.1:7731",
+			"127.0.0.1:7731",
+			"127.0.0.1:7730",
+			"test_group",
+			"127.0.0.1:81",
+		)
+		serf2 := registry.NewSerf(member2)
+		serf2.Start()
+		time.Sleep(sleepTime * 3)
+		serf2.Stop()
+	}()
+	assert.Nil(t, serf1.WaitForGroup(ctx, "test_group", 2))
+
+	short, cancelShort := context.WithTimeout(context.Background(), sleepTime)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, serf1.WaitForGroup(short, "other_group", 1))
+
+	<-stopped
+	serf1.Stop()
+}
+
+func Test_SerfSync(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	assert.True(t, serf1.Converged("test_id1"))
+	assert.False(t, serf1.Converged("test_id1", "test_id2"))
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"other_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, serf1.Sync(ctx, "test_id1", "test_id2"))
+	assert.True(t, serf1.Converged("test_id2"))
+
+	short, cancelShort := context.WithTimeout(context.Background(), sleepTime)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, serf1.Sync(short, "test_id3"))
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfSubscribeGroup(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	events, cancel := serf1.SubscribeGroup("other_group")
+	defer cancel()
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"other_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, registry.EventJoin, e.Type)
+		assert.Equal(t, "test_id2", e.Member.Id)
+	case <-time.After(time.Second):
+		t.Fatal("no join event received")
+	}
+
+	serf2.Stop()
+	select {
+	case e := <-events:
+		assert.Equal(t, registry.EventLeave, e.Type)
+		assert.Equal(t, "test_id2", e.Member.Id)
+	case <-time.After(time.Second):
+		t.Fatal("no leave event received")
+	}
+	serf1.Stop()
+}
+
+type panicHandler struct {
+	registry.BaseHandler
+}
+
+func (h *panicHandler) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+	panic("join " + m.Id)
+}
+
+func Test_SerfHandlerPanic(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(&panicHandler{})
+	panics := make(chan any, 4)
+	serf1.OnHandlerPanic(func(recovered any) {
+		panics <- recovered
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "join test_id1", <-panics)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "join test_id2", <-panics)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+// hangingHandler blocks joins until their context is cancelled.
+type hangingHandler struct {
+	registry.BaseHandler
+	cancelled chan error
+}
+
+func (h *hangingHandler) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+	if m.Id != "test_id2" {
+		return nil
+	}
+	<-ctx.Done()
+	h.cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+func Test_SerfHandlerTimeout(t *testing.T) {
+	handler := &hangingHandler{cancelled: make(chan error, 1)}
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(handler)
+	serf1.SetHandlerTimeout(sleepTime / 2)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime * 2)
+
+	// The timed out join is vetoed, and the handler sees its context cancelled.
+	assert.ErrorIs(t, <-handler.cancelled, context.DeadlineExceeded)
+	assert.Len(t, serf1.Members(), 1)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+// lateHandler applies joins after the handler timeout, ignoring the cancelled context.
+type lateHandler struct {
+	delay   time.Duration
+	lock    sync.Mutex
+	members map[string]bool
+	left    chan string
+}
+
+func (h *lateHandler) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+	if m.Id == "test_id2" {
+		time.Sleep(h.delay)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.members[m.Id] = true
+	return nil
+}
+
+func (h *lateHandler) OnMemberLeave(ctx context.Context, m *registry.Member) error {
+	h.lock.Lock()
+	delete(h.members, m.Id)
+	h.lock.Unlock()
+	h.left <- m.Id
+	return nil
+}
+
+func (h *lateHandler) OnMemberUpdate(ctx context.Context, m *registry.Member) error {
+	return nil
+}
+
+func (h *lateHandler) has(id string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.members[id]
+}
+
+func Test_SerfHandlerTimeoutReconcile(t *testing.T) {
+	handler := &lateHandler{delay: sleepTime, members: map[string]bool{}, left: make(chan string, 4)}
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(handler)
+	serf1.SetHandlerTimeout(sleepTime / 4)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	// The vetoed join lands in the handler late, and is retracted once it returns.
+	select {
+	case id := <-handler.left:
+		assert.Equal(t, "test_id2", id)
+	case <-time.After(sleepTime * 10):
+		t.Fatal("the vetoed member was not retracted")
+	}
+	assert.False(t, handler.has("test_id2"))
+	assert.Len(t, serf1.Members(), 1)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfStartMalformedRegistries(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		" 127.0.0.1:7731,,127.0.0.1,127.0.0.1:abc, 127.0.0.1:7731,",
+		"test_group",
+		"127.0.0.1:80",
+	)
+
+	serf := registry.NewSerf(member)
+	err := serf.Start()
+	assert.ErrorIs(t, err, registry.ErrParseRegistries)
+	assert.Contains(t, err.Error(), "127.0.0.1,127.0.0.1:abc")
+	serf.Stop()
+}
+
+func Test_SerfStartMalformedAddrs(t *testing.T) {
+	member := registry.NewMember("test_id", "127.0.0.1", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf := registry.NewSerf(member)
+	err := serf.Start()
+	assert.ErrorIs(t, err, registry.ErrBindAddr)
+	assert.ErrorIs(t, err, registry.ErrParseAddrToHostPort)
+	assert.NotErrorIs(t, err, registry.ErrAdvertiseAddr)
+	serf.Stop()
+
+	member = registry.NewMember("test_id", "127.0.0.1:7730", "127.0.0.1:abc", "", "test_group", "127.0.0.1:80")
+	serf = registry.NewSerf(member)
+	err = serf.Start()
+	assert.ErrorIs(t, err, registry.ErrAdvertiseAddr)
+	assert.ErrorIs(t, err, registry.ErrParsePort)
+	assert.NotErrorIs(t, err, registry.ErrBindAddr)
+	assert.Contains(t, err.Error(), "127.0.0.1:abc")
+	serf.Stop()
+}
+
+func Test_SerfAdvertiseResolver(t *testing.T) {
+	unavailable := errors.New("metadata unavailable")
+	member1 := registry.NewMember("test_id1", "127.0.0.1:7730", "", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	serf1.SetAdvertiseResolver(func() (string, error) {
+		return "", unavailable
+	})
+	err := serf1.Start()
+	assert.ErrorIs(t, err, registry.ErrAdvertiseResolver)
+	assert.ErrorIs(t, err, unavailable)
+	serf1.Stop()
+
+	serf1 = registry.NewSerf(member1)
+	serf1.SetAdvertiseResolver(func() (string, error) {
+		return "127.0.0.1", nil
+	})
+	assert.ErrorIs(t, serf1.Start(), registry.ErrAdvertiseAddr)
+	serf1.Stop()
+
+	serf1 = registry.NewSerf(member1)
+	serf1.SetAdvertiseResolver(func() (string, error) {
+		return "127.0.0.1:7730", nil
+	})
+	assert.Nil(t, serf1.Start())
+	assert.Equal(t, "127.0.0.1:7730", member1.Advertise)
+
+	member2 := registry.NewMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	assert.Nil(t, serf2.Start())
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 2
+	}, sleepTime*10, sleepTime/2)
+	for _, m := range serf2.Members() {
+		if m.Id == "test_id1" {
+			assert.Equal(t, "127.0.0.1:7730", m.Advertise)
+		}
+	}
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfBindRetry(t *testing.T) {
+	member := registry.NewMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+
+	// The previous process of a fast restart still holds the port.
+	l, err := net.Listen("tcp", "127.0.0.1:7730")
+	assert.Nil(t, err)
+	s := registry.NewSerf(member)
+	err = s.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "address already in use")
+	s.Stop()
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(sleepTime * 3)
+		l.Close()
+	}()
+	s = registry.NewSerf(member)
+	s.SetBindRetry(5, sleepTime)
+	assert.Nil(t, s.Start())
+	<-released
+	assert.Len(t, s.Members(), 1)
+	s.Stop()
+
+	// A malformed configuration fails at once.
+	s = registry.NewSerf(member)
+	s.SetBindRetry(5, time.Minute)
+	s.SetSerfConfig(func(cfg *serf.Config) {
+		cfg.ProtocolVersion = serf.ProtocolVersionMax + 1
+	})
+	assert.NotNil(t, s.Start())
+	s.Stop()
+}
+
+func Test_SerfBootstrap(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	s.SetBootstrap(false)
+	assert.ErrorIs(t, s.Start(), registry.ErrNoRegistries)
+	s.Stop()
+
+	s = registry.NewSerf(member)
+	s.SetBootstrap(true)
+	assert.Nil(t, s.Start())
+	s.Stop()
+}
+
+func Test_SerfStrictAdvertise(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"192.0.2.10:7730",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	s.SetStrictAdvertise(true)
+	err := s.Start()
+	assert.ErrorIs(t, err, registry.ErrLoopbackAdvertise)
+	s.Stop()
+}
+
+func Test_SerfDistanceTo(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+
+	serf := registry.NewSerf(member)
+	_, err := serf.Coordinate("test_id")
+	assert.Equal(t, registry.ErrNotStarted, err)
+
+	err = serf.Start()
+	assert.Nil(t, err)
+
+	coord, err := serf.Coordinate("test_id")
+	assert.Nil(t, err)
+	assert.NotNil(t, coord)
+
+	_, err = serf.DistanceTo("test_id")
+	assert.Nil(t, err)
+
+	_, err = serf.DistanceTo("unknown_id")
+	assert.Equal(t, registry.ErrMemberNotFound, err)
+	serf.Stop()
+}
+
+func Test_SerfMembersByDistance(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3)
+	assert.Eventually(t, func() bool {
+		for _, id := range []string{"node-1", "node-2"} {
+			if _, err := nodes[0].DistanceTo(id); err != nil {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, sleepTime)
+
+	members := nodes[0].MembersByDistance(registrytest.Group)
+	assert.Len(t, members, 3)
+	for i := 1; i < len(members); i++ {
+		prev, err := nodes[0].DistanceTo(members[i-1].Id)
+		assert.Nil(t, err)
+		rtt, err := nodes[0].DistanceTo(members[i].Id)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, prev, rtt)
+	}
+	assert.Empty(t, nodes[0].MembersByDistance("unknown_group"))
+
+	// Without coordinates the members come in ID order.
+	nodes = registrytest.StartTestCluster(t, 3, func(i int, s *registry.Serf) {
+		s.SetDisableCoordinates(true)
+	})
+	members = nodes[0].MembersByDistance(registrytest.Group)
+	assert.Len(t, members, 3)
+	for i, m := range members {
+		assert.Equal(t, fmt.Sprintf("node-%d", i), m.Id)
+	}
+}
+
+func Test_SerfMemberInterceptor(t *testing.T) {
+	var lock sync.Mutex
+	left := make([]string, 0)
+	errDropped := errors.New("dropped")
+
+	member1 := registry.NewMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	serf1.SetMemberInterceptor(func(m *registry.Member) (*registry.Member, error) {
+		if state, _ := m.GetTag("state"); m.Id == "test_id3" || state == "invalid" {
+			return nil, errDropped
+		}
+		m = m.Clone()
+		m.SetTag("zone", "local")
+		return m, nil
+	})
+	assert.Nil(t, serf1.Start())
+	events, cancel := serf1.Subscribe()
+	defer cancel()
+	go func() {
+		for e := range events {
+			if e.Type == registry.EventLeave {
+				lock.Lock()
+				left = append(left, e.Member.Id)
+				lock.Unlock()
+			}
+		}
+	}()
+
+	member2 := registry.NewMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	assert.Nil(t, serf2.Start())
+	member3 := registry.NewMember("test_id3", "127.0.0.1:7732", "127.0.0.1:7732", "127.0.0.1:7730", "test_group", "127.0.0.1:82")
+	serf3 := registry.NewSerf(member3)
+	assert.Nil(t, serf3.Start())
+
+	// test_id3 is dropped, the other members are tracked transformed.
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 3
+	}, sleepTime*20, sleepTime/2)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+	assert.Len(t, serf1.MembersByTag("zone", "local"), 2)
+
+	// A dropped update leaves the tracked version in place.
+	assert.Nil(t, serf2.UpdateTags(map[string]string{"version": "2", "state": "invalid"}))
+	assert.Eventually(t, func() bool {
+		return len(serf3.MembersByTag("version", "2")) == 1
+	}, sleepTime*20, sleepTime/2)
+	time.Sleep(sleepTime)
+	assert.Empty(t, serf1.MembersByTag("version", "2"))
+	assert.Len(t, serf1.MembersByTag("zone", "local"), 2)
+
+	// A tracked member is retired even though its leave is dropped, an untracked one isn't reported.
+	serf3.Stop()
+	serf2.Stop()
+	assert.Eventually(t, func() bool {
+		return len(serf1.Members()) == 1
+	}, sleepTime*50, sleepTime/2)
+	time.Sleep(sleepTime * 3)
+	lock.Lock()
+	assert.Equal(t, []string{"test_id2"}, left)
+	lock.Unlock()
+	serf1.Stop()
+}
+
+func Test_SerfDisableCoordinates(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+
+	serf := registry.NewSerf(member)
+	serf.SetDisableCoordinates(true)
+	err := serf.Start()
+	assert.Nil(t, err)
+
+	_, err = serf.Coordinate("test_id")
+	assert.Equal(t, registry.ErrCoordinatesDisabled, err)
+	_, err = serf.DistanceTo("test_id")
+	assert.Equal(t, registry.ErrCoordinatesDisabled, err)
+	serf.Stop()
+}
+
+func Test_SerfClusterStats(t *testing.T) {
+	member := registry.NewMember(
+		"test_id",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+
+	serf := registry.NewSerf(member)
+	_, err := serf.ClusterStats()
+	assert.Equal(t, registry.ErrNotStarted, err)
+	assert.Equal(t, 0, serf.HealthScore())
+
+	err = serf.Start()
+	assert.Nil(t, err)
+
+	stats, err := serf.ClusterStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Members)
+	assert.Equal(t, 0, stats.Failed)
+	assert.Equal(t, false, stats.Encrypted)
+	assert.Equal(t, "1", serf.Stats()["members"])
+	assert.Equal(t, stats.HealthScore, serf.HealthScore())
+	serf.Stop()
+}
+
+func Test_SerfReportHealth(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetHealthDebounce(sleepTime / 2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	serf2.ReportHealth(registry.HealthWarn)
+	serf2.ReportHealth(registry.HealthFail)
+	time.Sleep(sleepTime * 3)
+
+	health := make(map[string]registry.HealthStatus)
+	for _, m := range serf1.Members() {
+		health[m.Id] = m.Health()
+	}
+	assert.Equal(t, map[string]registry.HealthStatus{
+		"test_id1": registry.HealthPass,
+		"test_id2": registry.HealthFail,
+	}, health)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfHealthCheck(t *testing.T) {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, port, _ := net.SplitHostPort(service.Addr().String())
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err = serf1.Start()
+	assert.Nil(t, err)
+
+	// The gossip port is 7731, the addr tag is unused, and the resolver derives the service
+	// port from the http_port tag.
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:1",
+	)
+	member2.SetTag("http_port", port)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetAddressResolver(func(m *serf.Member) string {
+		return "127.0.0.1:" + m.Tags["http_port"]
+	})
+	serf2.SetHealthDebounce(sleepTime / 10)
+	serf2.SetHealthCheck(sleepTime/2, sleepTime)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	health := func() registry.HealthStatus {
+		for _, m := range serf1.Members() {
+			if val, ok := m.GetTag(registry.TagHealth); ok && m.Id == "test_id2" {
+				return registry.HealthStatus(val)
+			}
+		}
+		return ""
+	}
+	assert.Eventually(t, func() bool {
+		return health() == registry.HealthPass
+	}, sleepTime*20, sleepTime/2)
+
+	// The service goes down while its node keeps gossiping.
+	service.Close()
+	assert.Eventually(t, func() bool {
+		return health() == registry.HealthFail
+	}, sleepTime*20, sleepTime/2)
+	assert.Len(t, serf1.Members(), 2)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfLeaveGrace(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	clock := registry.NewFakeClock(time.Now())
+	serf1 := registry.NewSerf(member1)
+	serf1.SetClock(clock)
+	serf1.SetLeaveGrace(time.Minute)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	events, cancel := serf1.SubscribeGroup("test_group")
+	defer cancel()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	stopped := make(chan struct{})
+	go func() {
+		serf2.Stop()
+		close(stopped)
+	}()
+	for e := range events {
+		if e.Type == registry.EventLeave {
+			break
+		}
+	}
+
+	// The left member is kept as leaving during the grace window.
+	assert.Len(t, serf1.Members(), 2)
+	for _, m := range serf1.Members() {
+		assert.Equal(t, m.Id == "test_id2", m.IsLeaving())
+	}
+
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		return len(serf1.Members()) == 1
+	}, sleepTime*10, sleepTime/10)
+	<-stopped
+	serf1.Stop()
+}
+
+func Test_SerfInterface(t *testing.T) {
+	var loopback string
+	ifaces, err := net.Interfaces()
+	assert.Nil(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	member := registry.NewMember(
+		"test_id1",
+		"0.0.0.0:7730",
+		"0.0.0.0:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	s.SetInterface(loopback)
+	err = s.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:7730", s.LocalMember().Bind)
+	assert.Equal(t, "127.0.0.1:7730", s.LocalMember().Advertise)
+	changed, err := s.ReconcileAdvertise()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	s.Stop()
+
+	missing := registry.NewSerf(registry.NewMember(
+		"test_id2",
+		"0.0.0.0:7731",
+		"0.0.0.0:7731",
+		"",
+		"test_group",
+		"127.0.0.1:81",
+	))
+	missing.SetInterface("no-such-iface0")
+	err = missing.Start()
+	assert.ErrorIs(t, err, registry.ErrInterface)
+	missing.Stop()
+}
+
+// orderHandler records the events it observes.
+type orderHandler struct {
+	sync.Mutex
+	registry.BaseHandler
+	events []string
+}
+
+func (h *orderHandler) record(event string, m *registry.Member) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, event+":"+m.Id)
+}
+
+func (h *orderHandler) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+	h.record("join", m)
+	return nil
+}
+
+func (h *orderHandler) OnMemberUpdate(ctx context.Context, m *registry.Member) error {
+	h.record("update", m)
+	return nil
+}
+
+func (h *orderHandler) OnMemberLeave(ctx context.Context, m *registry.Member) error {
+	h.record("leave", m)
+	return nil
+}
+
+func Test_SerfEventOrder(t *testing.T) {
+	handler := &orderHandler{}
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(handler)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	events, cancel := serf1.Subscribe()
+	defer cancel()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, serf2.UpdateTags(map[string]string{"version": strconv.Itoa(i)}))
+		time.Sleep(sleepTime)
+	}
+	serf2.Stop()
+
+	expected := []string{"join:test_id2", "update:test_id2", "update:test_id2", "update:test_id2", "leave:test_id2"}
+	observed := make([]string, 0)
+	var seq uint64
+	for e := range events {
+		// The sequence numbers of the events of the node increase by one.
+		if seq != 0 {
+			assert.Equal(t, seq+1, e.Seq)
+		}
+		seq = e.Seq
+		if e.Member.Id != "test_id2" {
+			continue
+		}
+		observed = append(observed, e.Type.String()+":"+e.Member.Id)
+		if e.Type == registry.EventLeave {
+			break
+		}
+	}
+	serf1.Stop()
+
+	handler.Lock()
+	defer handler.Unlock()
+	recorded := make([]string, 0)
+	for _, e := range handler.events {
+		if strings.HasSuffix(e, ":test_id2") {
+			recorded = append(recorded, e)
+		}
+	}
+	assert.Equal(t, expected, recorded)
+	assert.Equal(t, expected, observed)
+}
+
+func Test_SerfMergeFunc(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	member1.SetTag("cluster", "prod")
+	serf1 := registry.NewSerf(member1)
+	serf1.SetMergeFunc(func(members []*registry.Member) error {
+		for _, m := range members {
+			if cluster, _ := m.GetTag("cluster"); cluster != "prod" {
+				return fmt.Errorf("member %s is in cluster %q", m.Id, cluster)
+			}
+		}
+		return nil
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag("cluster", "dev")
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	// The merge is vetoed by serf1, serf2 has no merge function and can't block it on its side.
+	serf2.Join([]string{"127.0.0.1:7730"})
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 1)
+
+	member3 := registry.NewMember(
+		"test_id3",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		"",
+		"test_group",
+		"127.0.0.1:82",
+	)
+	member3.SetTag("cluster", "prod")
+	serf3 := registry.NewSerf(member3)
+	err = serf3.Start()
+	assert.Nil(t, err)
+
+	err = serf3.Join([]string{"127.0.0.1:7730"})
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+
+	serf3.Stop()
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfClusterId(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetClusterId("prod")
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetClusterId("staging")
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	member3 := registry.NewMember(
+		"test_id3",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:82",
+	)
+	serf3 := registry.NewSerf(member3)
+	serf3.SetClusterId("prod")
+	err = serf3.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	assert.Len(t, serf1.Members(), 2)
+	assert.Len(t, serf2.Members(), 1)
+	assert.Len(t, serf3.Members(), 2)
+	tag, _ := serf1.LocalMember().GetTag(registry.TagClusterId)
+	assert.Equal(t, "prod", tag)
+
+	serf3.Stop()
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfMergeAndReplaceTags(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	assert.ErrorIs(t, s.MergeTags(map[string]string{"k": "v"}), registry.ErrNotStarted)
+	err := s.Start()
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, s.MergeTags(map[string]string{"k" + strconv.Itoa(i): "v"}))
+		}(i)
+	}
+	wg.Wait()
+	time.Sleep(sleepTime)
+
+	tags := s.LocalMember().GetTags()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "v", tags["k"+strconv.Itoa(i)])
+	}
+
+	err = s.ReplaceTags(map[string]string{"version": "2"})
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	tags = s.LocalMember().GetTags()
+	assert.Equal(t, "2", tags["version"])
+	assert.NotContains(t, tags, "k0")
+	assert.Equal(t, "test_group", tags[registry.TagGroup])
+	assert.Equal(t, "127.0.0.1:80", tags[registry.TagAddr])
+	s.Stop()
+}
+
+func Test_SerfOnTagsRejected(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	var rejected map[string]string
+	s.OnTagsRejected(func(attempted map[string]string) {
+		rejected = attempted
+	})
+	err := s.Start()
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.MergeTags(map[string]string{"version": "2"}))
+	assert.Nil(t, rejected)
+
+	err = s.MergeTags(map[string]string{"blob": strings.Repeat("x", 1024)})
+	assert.NotNil(t, err)
+	assert.Len(t, rejected["blob"], 1024)
+	assert.Equal(t, "2", rejected["version"])
+	assert.NotContains(t, s.LocalMember().GetTags(), "blob")
+	s.Stop()
+}
+
+func Test_SerfMergeTagsIfChanged(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 2)
+
+	changed, err := nodes[1].MergeTagsIfChanged(map[string]string{"version": "2"})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag("version", "2")) == 1
+	}, sleepTime*10, sleepTime/2)
+
+	// The same tags again are not gossiped, so the peers see no update.
+	version := nodes[0].MembershipVersion()
+	changed, err = nodes[1].MergeTagsIfChanged(map[string]string{"version": "2"})
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Nil(t, nodes[1].ReplaceTags(nodes[1].LocalMember().GetTags()))
+	time.Sleep(sleepTime * 3)
+	assert.Equal(t, version, nodes[0].MembershipVersion())
+
+	changed, err = nodes[1].MergeTagsIfChanged(map[string]string{"version": "3"})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag("version", "3")) == 1
+	}, sleepTime*10, sleepTime/2)
+}
+
+func Test_SerfDiff(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 3)
+	prev := make([]*registry.Member, 0)
+	for _, m := range nodes[0].Members() {
+		prev = append(prev, m.Clone())
+	}
+
+	joined, left, changed := nodes[0].Diff(prev)
+	assert.Empty(t, joined)
+	assert.Empty(t, left)
+	assert.Empty(t, changed)
+
+	assert.Nil(t, nodes[0].UpdateTags(map[string]string{"version": "2"}))
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{"version": "2"}))
+	nodes[2].Stop()
+	assert.Eventually(t, func() bool {
+		_, left, changed := nodes[0].Diff(prev)
+		return len(left) == 1 && len(changed) == 2
+	}, time.Second*5, sleepTime)
+
+	joined, left, changed = nodes[0].Diff(prev)
+	assert.Empty(t, joined)
+	assert.Equal(t, "node-2", left[0].Id)
+	assert.Equal(t, "node-0", changed[0].Id)
+	assert.Equal(t, "node-1", changed[1].Id)
+
+	joined, _, _ = nodes[0].Diff(nil)
+	assert.Len(t, joined, 2)
+}
+
+func Test_SerfOnMembersReplaced(t *testing.T) {
+	var lock sync.Mutex
+	var last []*registry.Member
+	calls, torn := 0, 0
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.OnMembersReplaced(func(prev, cur []*registry.Member) {
+		lock.Lock()
+		defer lock.Unlock()
+		// Every pair starts where the previous one ended.
+		if len(prev) != len(last) {
+			torn++
+		}
+		for i := range prev {
+			if i < len(last) && prev[i] != last[i] {
+				torn++
+			}
+		}
+		last = cur
+		calls++
+	})
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(last) == 2
+	}, sleepTime*10, sleepTime/2)
+	lock.Lock()
+	assert.Equal(t, "test_id1", last[0].Id)
+	assert.Equal(t, "test_id2", last[1].Id)
+	lock.Unlock()
+
+	assert.Nil(t, serf2.UpdateTags(map[string]string{"version": "2"}))
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		v, _ := last[1].GetTag("version")
+		return v == "2"
+	}, sleepTime*10, sleepTime/2)
+
+	serf2.Stop()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(last) == 1
+	}, sleepTime*10, sleepTime/2)
+
+	lock.Lock()
+	assert.Equal(t, "test_id1", last[0].Id)
+	assert.Zero(t, torn)
+	assert.GreaterOrEqual(t, calls, 4)
+	lock.Unlock()
+	serf1.Stop()
+}
+
+func Test_SerfMemberWithoutTags(t *testing.T) {
+	serf1 := registry.NewSerf(registry.NewSimpleMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730"))
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewSimpleMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731")
+	member2.Registries = "127.0.0.1:7730"
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+
+	assert.Nil(t, serf2.UpdateTags(nil))
+	assert.Nil(t, serf2.ReplaceTags(nil))
+	assert.Nil(t, serf2.UpdateTags(map[string]string{"version": "2"}))
+	assert.Eventually(t, func() bool {
+		return len(serf1.MembersByTag("version", "2")) == 1
+	}, sleepTime*10, sleepTime/2)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfRejoin(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	assert.ErrorIs(t, serf1.Rejoin(), registry.ErrRejoinDisabled)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetRejoinAfterLeave(true)
+	serf2.SetRejoinInterval(sleepTime, 3)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 2)
+	assert.ErrorIs(t, serf2.Rejoin(), registry.ErrNotLeft)
+
+	err = serf2.Leave()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 1)
+
+	// serf1 accepts the rejoined node once it has refuted its own leave.
+	err = serf2.Rejoin()
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(serf1.Members()) == 2
+	}, sleepTime*50, sleepTime)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfRejoinGivesUp(t *testing.T) {
+	member1 := registry.NewMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	assert.Nil(t, serf1.Start())
+
+	member2 := registry.NewMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	serf2.SetRejoinAfterLeave(true)
+	serf2.SetRejoinInterval(sleepTime, 2)
+	assert.Nil(t, serf2.Start())
+	assert.Nil(t, serf2.Leave())
+	serf1.Stop()
+
+	// A rejoin reaching no registry leaves serf shut down, so it can be retried.
+	assert.ErrorIs(t, serf2.Rejoin(), registry.ErrRejoin)
+	assert.ErrorIs(t, serf2.Rejoin(), registry.ErrRejoin)
+
+	serf1 = registry.NewSerf(member1)
+	assert.Nil(t, serf1.Start())
+	assert.Nil(t, serf2.Rejoin())
+	assert.Eventually(t, func() bool {
+		return len(serf1.Members()) == 2
+	}, sleepTime*50, sleepTime)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfRejoinForgetsLeftMembers(t *testing.T) {
+	member1 := registry.NewMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	assert.Nil(t, serf1.Start())
+
+	member2 := registry.NewMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	serf2.SetRejoinAfterLeave(true)
+	serf2.SetRejoinInterval(sleepTime, 3)
+	assert.Nil(t, serf2.Start())
+
+	member3 := registry.NewMember("test_id3", "127.0.0.1:7732", "127.0.0.1:7732", "127.0.0.1:7730", "test_group", "127.0.0.1:82")
+	serf3 := registry.NewSerf(member3)
+	assert.Nil(t, serf3.Start())
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 3
+	}, sleepTime*20, sleepTime/2)
+
+	events, cancel := serf2.Subscribe()
+	defer cancel()
+
+	// While left, the node no longer reports the members it can't hear about.
+	assert.Nil(t, serf2.Leave())
+	for _, m := range serf2.Members() {
+		assert.Equal(t, "test_id2", m.Id)
+	}
+	left := make(map[string]bool)
+	for len(left) < 2 {
+		select {
+		case e := <-events:
+			if e.Type == registry.EventLeave && e.Member.Id != "test_id2" {
+				left[e.Member.Id] = true
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("leaves not published, got %v", left)
+		}
+	}
+	assert.True(t, left["test_id1"] && left["test_id3"])
+
+	// test_id3 departs during the gap and is not tracked after the rejoin.
+	serf3.Stop()
+	assert.Nil(t, serf2.Rejoin())
+	assert.Eventually(t, func() bool {
+		return len(serf2.Members()) == 2
+	}, sleepTime*50, sleepTime)
+	time.Sleep(sleepTime * 3)
+	ids := make([]string, 0)
+	for _, m := range serf2.Members() {
+		ids = append(ids, m.Id)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"test_id1", "test_id2"}, ids)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfTagsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	err := os.WriteFile(path, []byte(`{"version": "1"}`), 0644)
+	assert.Nil(t, err)
+
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	s.SetTagsFile(path, sleepTime/2)
+	err = s.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	tags := s.LocalMember().GetTags()
+	assert.Equal(t, "1", tags["version"])
+	assert.Equal(t, "test_group", tags[registry.TagGroup])
+
+	err = os.WriteFile(path, []byte(`{"version": "2", "draining": "true"}`), 0644)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		tags := s.LocalMember().GetTags()
+		return tags["version"] == "2" && tags["draining"] == "true"
+	}, sleepTime*10, sleepTime/2)
+	s.Stop()
+
+	err = os.WriteFile(path, []byte(`not json`), 0644)
+	assert.Nil(t, err)
+	malformed := registry.NewSerf(registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"",
+		"test_group",
+		"127.0.0.1:81",
+	))
+	malformed.SetTagsFile(path, 0)
+	assert.ErrorIs(t, malformed.Start(), registry.ErrTagsFile)
+	malformed.Stop()
+}
+
+func Test_SerfKeyringFile(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	rotated := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	dir := t.TempDir()
+	path1 := filepath.Join(dir, "keyring1.json")
+	path2 := filepath.Join(dir, "keyring2.json")
+	for _, path := range []string{path1, path2} {
+		err := os.WriteFile(path, []byte(`["`+key+`"]`), 0600)
+		assert.Nil(t, err)
+	}
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetKeyringFile(path1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetKeyringFile(path2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	assert.Len(t, serf1.Members(), 2)
+	stats, err := serf1.ClusterStats()
+	assert.Nil(t, err)
+	assert.True(t, stats.Encrypted)
+	assert.True(t, serf1.EncryptionEnabled())
+
+	fp, err := registry.KeyFingerprint(key)
+	assert.Nil(t, err)
+	primary, err := serf2.PrimaryKeyFingerprint()
+	assert.Nil(t, err)
+	assert.Equal(t, fp, primary)
+
+	// The installed key is written through to the keyring file of every member.
+	assert.Nil(t, serf1.InstallKey(rotated))
+	for _, path := range []string{path1, path2} {
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		keys := make([]string, 0)
+		assert.Nil(t, json.Unmarshal(data, &keys))
+		assert.ElementsMatch(t, []string{key, rotated}, keys)
+	}
+	assert.NotNil(t, serf1.RemoveKey(key))
+
+	// The rotation has converged once every member uses the new primary key.
+	assert.Nil(t, serf1.UseKey(rotated))
+	fp, err = registry.KeyFingerprint(rotated)
+	assert.Nil(t, err)
+	fingerprints, err := serf1.PrimaryKeyFingerprints()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{fp: 2}, fingerprints)
+	primary, err = serf2.PrimaryKeyFingerprint()
+	assert.Nil(t, err)
+	assert.Equal(t, fp, primary)
+
+	serf2.Stop()
+	serf1.Stop()
+
+	err = os.WriteFile(path1, []byte(`["not base64"]`), 0600)
+	assert.Nil(t, err)
+	malformed := registry.NewSerf(member1)
+	malformed.SetKeyringFile(path1)
+	assert.ErrorIs(t, malformed.Start(), registry.ErrKeyring)
+	malformed.Stop()
+}
+
+func Test_SerfSecretKeyFingerprint(t *testing.T) {
+	key := "QHOYjmYlxSCBhdfiolhtDQ=="
+	secret, err := base64.StdEncoding.DecodeString(key)
+	assert.Nil(t, err)
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetSerfConfig(func(cfg *serf.Config) {
+		cfg.MemberlistConfig.SecretKey = secret
+	})
+	err = serf1.Start()
+	assert.Nil(t, err)
+
+	// The key set through the serf configuration is the one fingerprinted.
+	assert.True(t, serf1.EncryptionEnabled())
+	fp, err := registry.KeyFingerprint(key)
+	assert.Nil(t, err)
+	primary, err := serf1.PrimaryKeyFingerprint()
+	assert.Nil(t, err)
+	assert.Equal(t, fp, primary)
+	fingerprints, err := serf1.PrimaryKeyFingerprints()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{fp: 1}, fingerprints)
+	serf1.Stop()
+}
+
+func Test_SerfNoEncryption(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	_, err := serf1.PrimaryKeyFingerprint()
+	assert.ErrorIs(t, err, registry.ErrNotStarted)
+
+	err = serf1.Start()
+	assert.Nil(t, err)
+	assert.False(t, serf1.EncryptionEnabled())
+	_, err = serf1.PrimaryKeyFingerprint()
+	assert.ErrorIs(t, err, registry.ErrNoEncryption)
+	_, err = serf1.PrimaryKeyFingerprints()
+	assert.ErrorIs(t, err, registry.ErrNoEncryption)
+	serf1.Stop()
+}
+
+func Test_SerfGossipInterval(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	assert.ErrorIs(t, serf1.SetGossipInterval(0, 3), registry.ErrGossipConfig)
+	assert.ErrorIs(t, serf1.SetGossipInterval(100*time.Millisecond, 0), registry.ErrGossipConfig)
+	assert.ErrorIs(t, serf1.SetPushPullInterval(-time.Second), registry.ErrGossipConfig)
+	assert.Nil(t, serf1.SetGossipInterval(100*time.Millisecond, 4))
+	assert.Nil(t, serf1.SetPushPullInterval(15*time.Second))
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	assert.Nil(t, serf2.SetGossipInterval(100*time.Millisecond, 4))
+	assert.Nil(t, serf2.SetPushPullInterval(15*time.Second))
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	assert.Len(t, serf1.Members(), 2)
+	assert.Len(t, serf2.Members(), 2)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfSetSerfConfig(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	s := registry.NewSerf(member)
+	called := false
+	s.SetSerfConfig(func(cfg *serf.Config) {
+		called = true
+		cfg.NodeName = "clobbered"
+		cfg.Tags = nil
+		cfg.EventCh = nil
+		cfg.MemberlistConfig.ProbeTimeout = 200 * time.Millisecond
+	})
+	assert.Nil(t, s.Start())
+	assert.True(t, called)
+
+	members := s.SerfMembers()
+	assert.Len(t, members, 1)
+	assert.Equal(t, "test_id1", members[0].Name)
+	assert.Equal(t, "test_group", members[0].Tags[registry.TagGroup])
+	assert.Equal(t, "test_group", s.LocalMember().Service.Group)
+	s.Stop()
+}
+
+func Test_SerfMembershipVersion(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	assert.Equal(t, uint64(0), serf1.MembershipVersion())
+	err := serf1.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	started := serf1.MembershipVersion()
+	assert.Greater(t, started, uint64(0))
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+	joined := serf1.MembershipVersion()
+	assert.Greater(t, joined, started)
+
+	// Nothing changed, the version stays the same.
+	time.Sleep(sleepTime)
+	assert.Equal(t, joined, serf1.MembershipVersion())
+
+	serf2.Stop()
+	time.Sleep(sleepTime)
+	assert.Greater(t, serf1.MembershipVersion(), joined)
+	serf1.Stop()
+}
+
+func Test_SerfLeavePropagateDelay(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+	events, cancel := serf1.Subscribe()
+	defer cancel()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	serf2.SetLeavePropagateDelay(2 * time.Second)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	// The graceful leave waits for the leave to propagate.
+	begin := time.Now()
+	assert.Nil(t, serf2.Leave())
+	assert.GreaterOrEqual(t, time.Since(begin), 2*time.Second)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Member.Id != "test_id2" || e.Type == registry.EventJoin {
+				continue
+			}
+			assert.Equal(t, registry.EventLeave, e.Type)
+		case <-timeout:
+			t.Fatal("leave of test_id2 is not observed")
+		}
+		break
+	}
+	serf1.Stop()
+}
+
+func Test_SerfClose(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	var closer io.Closer = serf2
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	// The pending health report is cancelled by Close.
+	serf2.ReportHealth(registry.HealthWarn)
+	assert.Nil(t, closer.Close())
+	time.Sleep(sleepTime)
+	assert.Len(t, serf1.Members(), 1)
+
+	// Closing a Serf that has already left the cluster is fine.
+	assert.Nil(t, serf1.Leave())
+	assert.Nil(t, serf1.Close())
+}
+
+func Test_SerfOnLoopExit(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	exits := make(chan error, 2)
+	serf1.OnLoopExit(func(err error) {
+		exits <- err
+	})
+	serf1.SetRejoinAfterLeave(true)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	// Leaving and stopping are planned exits.
+	assert.Nil(t, serf1.Leave())
+	assert.Nil(t, <-exits)
+	assert.Nil(t, serf1.Rejoin())
+	serf1.Stop()
+	assert.Nil(t, <-exits)
+	assert.Len(t, exits, 0)
+}
+
+func Test_SerfTagsFromEnv(t *testing.T) {
+	t.Setenv("REGISTRY_TEST_VERSION", "1.2.0")
+	t.Setenv("REGISTRY_TEST_PORT", "8080")
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:${REGISTRY_TEST_PORT}",
+	)
+	member1.SetTag("version", "v${REGISTRY_TEST_VERSION}")
+	member1.SetTag("zone", "${REGISTRY_TEST_ZONE:-unknown}")
+	serf1 := registry.NewSerf(member1)
+	serf1.SetTagsFromEnv(true)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	local := serf1.LocalMember()
+	assert.Equal(t, "127.0.0.1:8080", local.Service.Addr)
+	version, _ := local.GetTag("version")
+	assert.Equal(t, "v1.2.0", version)
+	zone, _ := local.GetTag("zone")
+	assert.Equal(t, "unknown", zone)
+	serf1.Stop()
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag("zone", "${REGISTRY_TEST_ZONE}")
+	serf2 := registry.NewSerf(member2)
+	serf2.SetTagsFromEnv(true)
+	err = serf2.Start()
+	assert.ErrorIs(t, err, registry.ErrTagEnv)
+	assert.Contains(t, err.Error(), "REGISTRY_TEST_ZONE")
+	serf2.Stop()
+}
+
+func Test_SerfTagsFileFromEnv(t *testing.T) {
+	t.Setenv("REGISTRY_TEST_VERSION", "1.2.0")
+	path := filepath.Join(t.TempDir(), "tags.json")
+	err := os.WriteFile(path, []byte(`{"version": "1"}`), 0644)
+	assert.Nil(t, err)
+
+	nodes := registrytest.StartTestCluster(t, 2, func(i int, s *registry.Serf) {
+		if i == 1 {
+			s.SetTagsFile(path, sleepTime/2)
+			s.SetTagsFromEnv(true)
+		}
+	})
+
+	// A reload resolves the environment variables like Start, and gossips the resolved tags.
+	err = os.WriteFile(path, []byte(`{"version": "v${REGISTRY_TEST_VERSION}", "zone": "${REGISTRY_TEST_ZONE:-unknown}"}`), 0644)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].MembersByTag("version", "v1.2.0")) == 1 &&
+			len(nodes[0].MembersByTag("zone", "unknown")) == 1
+	}, sleepTime*20, sleepTime/2)
+
+	// A reload referencing a variable that is not set is not applied.
+	err = os.WriteFile(path, []byte(`{"version": "${REGISTRY_TEST_UNSET}"}`), 0644)
+	assert.Nil(t, err)
+	time.Sleep(sleepTime * 3)
+	version, _ := nodes[1].LocalMember().GetTag("version")
+	assert.Equal(t, "v1.2.0", version)
+	assert.Len(t, nodes[0].MembersByTag("version", "v1.2.0"), 1)
+}
+
+func Test_SerfOnAddressChanged(t *testing.T) {
+	changes := make(chan []string, 4)
+	nodes := registrytest.StartTestCluster(t, 2, func(i int, s *registry.Serf) {
+		if i == 0 {
+			s.OnAddressChanged(func(m *registry.Member, oldAddr string, newAddr string) {
+				changes <- []string{m.Id, oldAddr, newAddr}
+			})
+		}
+	})
+
+	old := nodes[1].LocalMember().Service.Addr
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{"version": "1.2.0"}))
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{registry.TagAddr: "127.0.0.1:9000"}))
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, []string{"node-1", old, "127.0.0.1:9000"}, change)
+	case <-time.After(5 * time.Second):
+		t.Fatal("address change is not observed")
+	}
+	time.Sleep(sleepTime)
+	assert.Len(t, changes, 0)
+}
+
+func Test_SerfOnReplicasChanged(t *testing.T) {
+	changes := make(chan []any, 4)
+	nodes := registrytest.StartTestCluster(t, 2, func(i int, s *registry.Serf) {
+		if i == 0 {
+			s.OnReplicasChanged(func(m *registry.Member, old int, latest int) {
+				changes <- []any{m.Id, old, latest}
+			})
+		}
+	})
+
+	old, err := strconv.Atoi(nodes[1].LocalMember().Replicas)
+	assert.Nil(t, err)
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{"version": "1.2.0"}))
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{registry.TagReplicas: strconv.Itoa(old + 5)}))
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, []any{"node-1", old, old + 5}, change)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replicas change is not observed")
+	}
+
+	// An update keeping the replicas doesn't report a change.
+	assert.Nil(t, nodes[1].UpdateTags(map[string]string{"version": "1.3.0"}))
+	assert.Eventually(t, func() bool {
+		for _, m := range nodes[0].Members() {
+			if v, _ := m.GetTag("version"); m.Id == "node-1" && v == "1.3.0" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, sleepTime/2)
+	assert.Len(t, changes, 0)
+}
+
+func Test_SerfMaxMembers(t *testing.T) {
+	overflows := make(chan string, 4)
+	nodes := registrytest.StartTestCluster(t, 2, func(i int, s *registry.Serf) {
+		if i == 0 {
+			s.SetMaxMembers(2)
+			s.OnMemberOverflow(func(m *registry.Member) {
+				overflows <- m.Id
+			})
+		}
+	})
+
+	member3 := registry.NewMember(
+		"test_id3",
+		"127.0.0.1:7732",
+		"127.0.0.1:7732",
+		nodes[0].LocalMember().Advertise,
+		registrytest.Group,
+		"127.0.0.1:82",
+	)
+	serf3 := registry.NewSerf(member3)
+	err := serf3.Start()
+	assert.Nil(t, err)
+	defer serf3.Stop()
+
+	select {
+	case id := <-overflows:
+		assert.Equal(t, "test_id3", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("member overflow is not observed")
+	}
+	assert.Eventually(t, func() bool {
+		return len(nodes[1].Members()) == 3
+	}, 5*time.Second, sleepTime)
+	assert.Len(t, nodes[0].Members(), 2)
+}
+
+func Test_SerfUpdateAdvertise(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	assert.ErrorIs(t, serf2.UpdateAdvertise("127.0.0.1:7732"), registry.ErrNotStarted)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	assert.ErrorIs(t, serf2.UpdateAdvertise("127.0.0.1"), registry.ErrParseAddrToHostPort)
+	_, err = serf2.ReconcileAdvertise()
+	assert.ErrorIs(t, err, registry.ErrInterface)
+
+	// The peer learns the new address of the member.
+	assert.Nil(t, serf2.UpdateAdvertise("127.0.0.1:7732"))
+	assert.Equal(t, "127.0.0.1:7732", serf2.LocalMember().Bind)
+	assert.Eventually(t, func() bool {
+		for _, m := range serf1.Members() {
+			if m.Id == "test_id2" && m.Advertise == "127.0.0.1:7732" && !m.IsLeaving() {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, sleepTime)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfUpdateAdvertiseRollback(t *testing.T) {
+	member1 := registry.NewMember("test_id1", "127.0.0.1:7730", "127.0.0.1:7730", "", "test_group", "127.0.0.1:80")
+	serf1 := registry.NewSerf(member1)
+	assert.Nil(t, serf1.Start())
+
+	member2 := registry.NewMember("test_id2", "127.0.0.1:7731", "127.0.0.1:7731", "127.0.0.1:7730", "test_group", "127.0.0.1:81")
+	serf2 := registry.NewSerf(member2)
+	serf2.SetRejoinInterval(sleepTime, 3)
+	assert.Nil(t, serf2.Start())
+	time.Sleep(sleepTime)
+
+	// The new address can't be bound, the member rejoins from the previous one.
+	l, err := net.Listen("tcp", "127.0.0.1:7732")
+	assert.Nil(t, err)
+	defer l.Close()
+	err = serf2.UpdateAdvertise("127.0.0.1:7732")
+	assert.ErrorIs(t, err, registry.ErrReadvertise)
+	assert.Contains(t, err.Error(), "rolled back to 127.0.0.1:7731")
+	assert.Equal(t, "127.0.0.1:7731", member2.Advertise)
+	assert.Equal(t, "127.0.0.1:7731", member2.Bind)
+	assert.Eventually(t, func() bool {
+		for _, m := range serf1.Members() {
+			if m.Id == "test_id2" && m.Advertise == "127.0.0.1:7731" && !m.IsLeaving() {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, sleepTime)
+	assert.Len(t, serf2.Members(), 2)
+
+	serf2.Stop()
+	serf1.Stop()
+}
+
+func Test_SerfDescribe(t *testing.T) {
+	member := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	member.SetTag(registry.TagService, "payments")
+	s := registry.NewSerf(member)
+	assert.Contains(t, s.Describe(), "serf: not started\n")
+
+	err := s.Start()
+	assert.Nil(t, err)
+	description := s.Describe()
+	assert.Contains(t, description, "serf: alive\n")
+	assert.Contains(t, description, "local member: id=test_id1 name=test_id1 bind=127.0.0.1:7730 advertise=127.0.0.1:7730")
+	assert.Contains(t, description, "members: 1,")
+	assert.Contains(t, description, "groups: test_group=1\n")
+	assert.Contains(t, description, "services: payments=1\n")
+	assert.Contains(t, description, "encryption: off\n")
+	assert.Contains(t, description, "gossip: protocol=default")
+	assert.Contains(t, description, "members=1")
+	s.Stop()
+}
+
+func Test_SerfKV(t *testing.T) {
+	var lock sync.Mutex
+	changes := make(map[string]string)
+	nodes := registrytest.StartTestCluster(t, 2, func(i int, s *registry.Serf) {
+		s.SetKVMaxKeys(2)
+		if i == 1 {
+			s.OnKVChange(func(key, value string) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes[key] = value
+			})
+		}
+	})
+
+	kv := nodes[0].KV()
+	assert.Nil(t, kv.Set("flag", "on"))
+	value, ok := kv.Get("flag")
+	assert.True(t, ok)
+	assert.Equal(t, "on", value)
+
+	// The write reaches the other member.
+	assert.Eventually(t, func() bool {
+		value, _ := nodes[1].KV().Get("flag")
+		return value == "on"
+	}, 5*time.Second, sleepTime)
+	lock.Lock()
+	assert.Equal(t, map[string]string{"flag": "on"}, changes)
+	lock.Unlock()
+
+	// The last write wins on every member.
+	assert.Nil(t, nodes[1].KV().Set("flag", "off"))
+	assert.Eventually(t, func() bool {
+		value, _ := kv.Get("flag")
+		return value == "off"
+	}, 5*time.Second, sleepTime)
+
+	assert.Nil(t, kv.Set("limit", "10"))
+	assert.ErrorIs(t, kv.Set("third", "x"), registry.ErrKVFull)
+	assert.ErrorIs(t, kv.Set("limit", strings.Repeat("x", registry.KVSizeLimit)), registry.ErrKVTooLarge)
+	assert.Equal(t, 2, kv.Keys())
+
+	_, ok = kv.Get("missing")
+	assert.False(t, ok)
+	assert.ErrorIs(t, registry.NewSerf(registry.NewSimpleMember("test_id", "", "")).KV().Set("flag", "on"), registry.ErrNotStarted)
+}
+
+func Test_SerfReplayEvents(t *testing.T) {
+	nodes := registrytest.StartTestCluster(t, 1)
+	assert.Nil(t, nodes[0].KV().Set("flag", "on"))
+
+	join := func(id string, port int, replay bool) *registry.Serf {
+		addr := "127.0.0.1:" + strconv.Itoa(port)
+		s := registry.NewSerf(registry.NewMember(id, addr, addr, nodes[0].LocalMember().Advertise, registrytest.Group, addr))
+		s.SetReplayEvents(replay)
+		assert.Nil(t, s.Start())
+		return s
+	}
+
+	// A joiner replaying the events catches up on the write broadcast before it joined.
+	replayed := join("test_id2", 7732, true)
+	defer replayed.Stop()
+	assert.Eventually(t, func() bool {
+		value, _ := replayed.KV().Get("flag")
+		return value == "on"
+	}, 5*time.Second, sleepTime/2)
+
+	// A joiner not replaying them only sees the writes broadcast once it is a member.
+	skipped := join("test_id3", 7733, false)
+	defer skipped.Stop()
+	assert.Nil(t, nodes[0].KV().Set("after", "on"))
+	assert.Eventually(t, func() bool {
+		value, _ := skipped.KV().Get("after")
+		return value == "on"
+	}, 5*time.Second, sleepTime/2)
+	_, ok := skipped.KV().Get("flag")
+	assert.False(t, ok)
+}
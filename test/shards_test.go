@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+func Test_SerfMembersForShard(t *testing.T) {
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	member1.SetTag(registry.TagShards, "0-3,7")
+	serf1 := registry.NewSerf(member1)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	member2.SetTag(registry.TagShards, "3-6")
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	time.Sleep(sleepTime)
+
+	ids := func(members []*registry.Member) []string {
+		list := make([]string, 0)
+		for _, m := range members {
+			list = append(list, m.Id)
+		}
+		return list
+	}
+	assert.Equal(t, []string{"test_id1"}, ids(serf1.MembersForShard("test_group", 0)))
+	assert.Equal(t, []string{"test_id1", "test_id2"}, ids(serf1.MembersForShard("test_group", 3)))
+	assert.Equal(t, []string{"test_id2"}, ids(serf1.MembersForShard("test_group", 5)))
+	assert.Empty(t, serf1.MembersForShard("test_group", 8))
+
+	// Shard 3 is owned twice and shard 8 by nobody.
+	err = serf1.CheckShards("test_group", 9)
+	assert.ErrorIs(t, err, registry.ErrShardCoverage)
+	assert.Contains(t, err.Error(), "missing:[8]")
+	assert.Contains(t, err.Error(), "overlapping:[3]")
+
+	assert.Nil(t, serf2.UpdateTags(map[string]string{registry.TagShards: "4-6"}))
+	time.Sleep(sleepTime)
+	assert.Nil(t, serf1.CheckShards("test_group", 8))
+	assert.ErrorIs(t, serf1.CheckShards("test_group", 7), registry.ErrShardCoverage)
+	assert.ErrorIs(t, serf1.CheckShards("test_group", 0), registry.ErrShardCoverage)
+	assert.ErrorIs(t, serf1.CheckShards("test_group", -1), registry.ErrShardCoverage)
+
+	assert.Nil(t, serf2.UpdateTags(map[string]string{registry.TagShards: "6-4"}))
+	time.Sleep(sleepTime)
+	assert.ErrorIs(t, serf1.CheckShards("test_group", 8), registry.ErrShardTag)
+	assert.Equal(t, []string{"test_id1"}, ids(serf1.MembersForShard("test_group", 0)))
+
+	serf2.Stop()
+	serf1.Stop()
+}
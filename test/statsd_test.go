@@ -0,0 +1,45 @@
+package test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+)
+
+func Test_StatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = registry.NewStatsD(conn.LocalAddr().String(), "registry.", 0)
+	assert.ErrorIs(t, err, registry.ErrFlushInterval)
+	_, err = registry.NewStatsD(conn.LocalAddr().String(), "registry.", -time.Second)
+	assert.ErrorIs(t, err, registry.ErrFlushInterval)
+
+	statsd, err := registry.NewStatsD(conn.LocalAddr().String(), "registry.", time.Hour)
+	assert.Nil(t, err)
+
+	statsd.IncrCounter(registry.MetricMemberJoin, 1)
+	statsd.SetGauge("members", 2)
+	statsd.ObserveDuration(registry.MetricHandlerDispatch, 1500*time.Microsecond)
+	statsd.ObserveHandlerDuration("OnMemberJoin", 2*time.Millisecond)
+	assert.Nil(t, statsd.Close())
+	assert.Nil(t, statsd.Close(), "closing again is a no-op")
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+	assert.Equal(t, []string{
+		"registry.member_join_total:1|c",
+		"registry.members:2|g",
+		"registry.handler_dispatch:1.5|ms",
+		"registry.handler_duration.OnMemberJoin:2|ms",
+	}, lines)
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/werbenhu/registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedHandler fails the join of test_id2, and records whether the handler calls carry a span.
+type tracedHandler struct {
+	sync.Mutex
+	registry.BaseHandler
+	untraced int
+}
+
+func (h *tracedHandler) OnMemberJoin(ctx context.Context, m *registry.Member) error {
+	h.Lock()
+	defer h.Unlock()
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		h.untraced++
+	}
+	if m.Id == "test_id2" {
+		return errors.New("join failed")
+	}
+	return nil
+}
+
+func Test_SerfTracerProvider(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	handler := &tracedHandler{}
+
+	member1 := registry.NewMember(
+		"test_id1",
+		"127.0.0.1:7730",
+		"127.0.0.1:7730",
+		"",
+		"test_group",
+		"127.0.0.1:80",
+	)
+	serf1 := registry.NewSerf(member1)
+	serf1.SetHandler(handler)
+	serf1.SetTracerProvider(provider)
+	err := serf1.Start()
+	assert.Nil(t, err)
+
+	member2 := registry.NewMember(
+		"test_id2",
+		"127.0.0.1:7731",
+		"127.0.0.1:7731",
+		"127.0.0.1:7730",
+		"test_group",
+		"127.0.0.1:81",
+	)
+	serf2 := registry.NewSerf(member2)
+	err = serf2.Start()
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(recorder.Ended()) >= 2
+	}, sleepTime*10, sleepTime/10)
+
+	// Every handler call is wrapped in a span carrying the event and the member.
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, "OnMemberJoin", span.Name())
+		attrs := attribute.NewSet(span.Attributes()...)
+		event, _ := attrs.Value("registry.event")
+		assert.Equal(t, "member-join", event.AsString())
+		id, _ := attrs.Value("registry.member.id")
+		spans[id.AsString()] = span
+	}
+	assert.Equal(t, codes.Unset, spans["test_id1"].Status().Code)
+
+	// A failing handler call records the error on its span.
+	assert.Equal(t, codes.Error, spans["test_id2"].Status().Code)
+	assert.Equal(t, "join failed", spans["test_id2"].Status().Description)
+	assert.Len(t, spans["test_id2"].Events(), 1)
+
+	handler.Lock()
+	assert.Zero(t, handler.untraced)
+	handler.Unlock()
+
+	serf2.Stop()
+	serf1.Stop()
+	assert.Nil(t, provider.Shutdown(context.Background()))
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 werbenhu
+// SPDX-FileContributor: werbenhu
+
+package registry
+
+import (
+	"context"
+
+	"github.com/hashicorp/serf/serf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans created by the registry.
+const tracerName = "github.com/werbenhu/registry"
+
+// SetTracerProvider sets the OpenTelemetry provider used to trace handler dispatch.
+// Each handler call is wrapped in a span carrying the event type and member ID.
+// When no provider is set, no spans are created. It must be called before Start.
+func (s *Serf) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		s.tracer = nil
+		return
+	}
+	s.tracer = tp.Tracer(tracerName)
+}
+
+// startSpan starts a span for dispatching an event of a member to the handler, and returns
+// the context carrying it. It returns ctx and a nil span if no tracer provider is set.
+func (s *Serf) startSpan(ctx context.Context, method string, t serf.EventType, m *Member) (context.Context, trace.Span) {
+	if s.tracer == nil {
+		return ctx, nil
+	}
+	return s.tracer.Start(ctx, method, trace.WithAttributes(
+		attribute.String("registry.event", t.String()),
+		attribute.String("registry.member.id", m.Id),
+	))
+}
+
+// endSpan records the handler result on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}